@@ -0,0 +1,353 @@
+package tnnlr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"labix.org/v2/mgo/bson"
+)
+
+/*
+A json api for scripts, under /api/v1.
+
+Unlike the web UI, which redirects back to the homepage and reports through messages, every endpoint
+responds with json and a status code saying how the request went:
+
+	200 done, 201 created, 204 deleted
+	400 the body isn't json
+	404 no tunnel or profile with that id or name, or no tunnels file
+	422 the tunnel or tunnels file is invalid, with every problem under "errors"
+	500 anything else, e.g. a tunnel whose port is taken failing to start
+
+Errors are `{"error": "..."}`, plus a list of `{"index", "field", "message"}` for validation errors.
+Both the api and the web UI work through the same methods on Tnnlr.
+*/
+
+// A managed tunnel as returned by the api, along with its state
+// Tunnels sent back as-is are accepted, the extra fields are ignored.
+type apiTunnel struct {
+	Tunnel
+	Profile         string `json:"profile"`
+	Status          string `json:"status"`
+	ConnectionState string `json:"connectionState,omitempty"`
+	RestartInfo     string `json:"restartInfo,omitempty"`
+}
+
+// Keys accepted in request bodies
+var apiTunnelFieldNames = func() map[string]bool {
+	names := fileFieldNames(apiTunnel{})
+	for name := range tunnelFieldNames {
+		names[name] = true
+	}
+	return names
+}()
+
+func newApiTunnel(tnnl *Tunnel) apiTunnel {
+	return apiTunnel{
+		Tunnel:          *tnnl,
+		Profile:         tnnl.Profile(),
+		Status:          tnnl.Status(),
+		ConnectionState: tnnl.ConnectionState(),
+		RestartInfo:     tnnl.RestartInfo(),
+	}
+}
+
+func (t *Tnnlr) apiRoutes(api *gin.RouterGroup) {
+	api.GET("/tunnels", t.ApiListTunnels)
+	api.POST("/tunnels", t.ApiCreateTunnel)
+	api.GET("/tunnels/:id", t.ApiGetTunnel)
+	api.PUT("/tunnels/:id", t.ApiUpdateTunnel)
+	api.DELETE("/tunnels/:id", t.ApiDeleteTunnel)
+	api.POST("/tunnels/:id/start", t.ApiStartTunnel)
+	api.POST("/tunnels/:id/stop", t.ApiStopTunnel)
+	api.POST("/tunnels/:id/restart", t.ApiRestartTunnel)
+	api.GET("/tunnels/:id/logs", t.ApiTunnelLogs)
+	api.GET("/tunnels/:id/command", t.ApiTunnelCommand)
+	api.GET("/profiles", t.ApiListProfiles)
+	api.POST("/profiles/:profile/save", t.ApiSaveProfile)
+	api.POST("/profiles/:profile/reload", t.ApiReloadProfile)
+}
+
+// Respond with an error, with the status picked from the kind of error
+func apiError(c *gin.Context, message string, err error) {
+	log.WithFields(log.Fields{
+		"err":  err.Error(),
+		"path": c.Request.URL.Path,
+	}).Error(message)
+	switch e := err.(type) {
+	case ValidationErrors:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": message, "errors": e})
+	case TunnelNotFoundError:
+		c.JSON(http.StatusNotFound, gin.H{"error": e.Error()})
+	default:
+		status := http.StatusInternalServerError
+		if os.IsNotExist(err) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": fmt.Sprintf("%s: %s", message, err.Error())})
+	}
+}
+
+// Read a tunnel from a request's json body
+// Responds with an error and returns false if the body isn't a valid tunnel.
+func bindApiTunnel(c *gin.Context) (apiTunnel, bool) {
+	var tnnl apiTunnel
+	raw, err := c.GetRawData()
+	if err == nil {
+		var fields map[string]interface{}
+		if err = json.Unmarshal(raw, &fields); err == nil {
+			if errs := unknownTunnelKeys(-1, fields, apiTunnelFieldNames); len(errs) > 0 {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Invalid tunnel", "errors": errs})
+				return tnnl, false
+			}
+			err = json.Unmarshal(raw, &tnnl)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid json: %s", err.Error())})
+		return tnnl, false
+	}
+	return tnnl, true
+}
+
+// Look up the tunnel named by the request's id, responding with a 404 if there isn't one
+func (t *Tnnlr) apiTunnel(c *gin.Context) (*Tunnel, bool) {
+	tnnl, err := t.Tunnel(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return tnnl, true
+}
+
+// List managed tunnels, sorted by profile and name
+// Only those of one profile with `?profile=`
+func (t *Tnnlr) ApiListTunnels(c *gin.Context) {
+	var tunnels map[string]*Tunnel
+	if name := c.Query("profile"); name != "" {
+		p, err := t.profile(name)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		tunnels = t.ProfileTunnels(p.Name)
+	} else {
+		tunnels = t.ManagedTunnels()
+	}
+
+	list := []apiTunnel{}
+	for _, tnnl := range tunnels {
+		list = append(list, newApiTunnel(tnnl))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Profile != list[j].Profile {
+			return list[i].Profile < list[j].Profile
+		}
+		return list[i].Name < list[j].Name
+	})
+	c.JSON(http.StatusOK, gin.H{"tunnels": list})
+}
+
+func (t *Tnnlr) ApiGetTunnel(c *gin.Context) {
+	if tnnl, ok := t.apiTunnel(c); ok {
+		c.JSON(http.StatusOK, newApiTunnel(tnnl))
+	}
+}
+
+// Add and start a tunnel
+// The tunnel goes into the profile in its "profile" field or `?profile=`, or the default profile.
+func (t *Tnnlr) ApiCreateTunnel(c *gin.Context) {
+	body, ok := bindApiTunnel(c)
+	if !ok {
+		return
+	}
+	name := body.Profile
+	if name == "" {
+		name = c.Query("profile")
+	}
+	p, err := t.profile(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	tnnl := body.Tunnel
+	tnnl.profile, tnnl.Pid = p.Name, 0
+	if tnnl.Id == "" {
+		tnnl.Id = bson.NewObjectId().Hex()
+	}
+	if err := t.AddTunnel(tnnl); err != nil {
+		apiError(c, fmt.Sprintf("Unable to add tunnel '%s'", tnnl.Name), err)
+		return
+	}
+
+	created, err := t.Tunnel(tnnl.Id)
+	if err != nil {
+		apiError(c, "Tunnel was removed while being added", err)
+		return
+	}
+	c.Header("Location", fmt.Sprintf("/api/v1/tunnels/%s", tnnl.Id))
+	c.JSON(http.StatusCreated, newApiTunnel(created))
+}
+
+// Replace a tunnel's definition, restarting it if its connection changed
+// The tunnel keeps its id and profile, whatever the body says.
+func (t *Tnnlr) ApiUpdateTunnel(c *gin.Context) {
+	body, ok := bindApiTunnel(c)
+	if !ok {
+		return
+	}
+	tnnl, _, err := t.UpdateTunnel(c.Param("id"), body.Tunnel)
+	if err != nil {
+		apiError(c, "Unable to update tunnel", err)
+		return
+	}
+	c.JSON(http.StatusOK, newApiTunnel(tnnl))
+}
+
+// Stop and remove a tunnel
+func (t *Tnnlr) ApiDeleteTunnel(c *gin.Context) {
+	if err := t.RemoveTunnel(c.Param("id")); err != nil {
+		apiError(c, "Unable to remove tunnel", err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (t *Tnnlr) ApiStartTunnel(c *gin.Context) {
+	t.apiTunnelAction(c, "start", t.StartTunnel)
+}
+
+func (t *Tnnlr) ApiStopTunnel(c *gin.Context) {
+	t.apiTunnelAction(c, "stop", t.StopTunnel)
+}
+
+func (t *Tnnlr) ApiRestartTunnel(c *gin.Context) {
+	t.apiTunnelAction(c, "restart", t.RestartTunnel)
+}
+
+// Run an action on the requested tunnel, responding with the tunnel as it is afterwards
+func (t *Tnnlr) apiTunnelAction(c *gin.Context, name string, action func(string) error) {
+	if err := action(c.Param("id")); err != nil {
+		apiError(c, fmt.Sprintf("Unable to %s tunnel", name), err)
+		return
+	}
+	if tnnl, ok := t.apiTunnel(c); ok {
+		c.JSON(http.StatusOK, newApiTunnel(tnnl))
+	}
+}
+
+// The tunnel's log file, as plain text
+func (t *Tnnlr) ApiTunnelLogs(c *gin.Context) {
+	tnnl, ok := t.apiTunnel(c)
+	if !ok {
+		return
+	}
+	logfilePath, err := t.backendFor(tnnl).LogPath(tnnl)
+	if err == nil {
+		_, err = os.Stat(logfilePath)
+	}
+	if err != nil {
+		apiError(c, "Unable to find logfile for tunnel", err)
+		return
+	}
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.File(logfilePath)
+}
+
+// The command the tunnel runs, as shown by "Show command" in the web UI
+func (t *Tnnlr) ApiTunnelCommand(c *gin.Context) {
+	tnnl, ok := t.apiTunnel(c)
+	if !ok {
+		return
+	}
+	files, err := ExportTunnels([]*Tunnel{tnnl}, ExportCommand, t.SshExec)
+	if err != nil {
+		apiError(c, "Unable to show command for tunnel", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":      tnnl.Id,
+		"command": strings.TrimSpace(string(files[0].Content)),
+	})
+}
+
+// List profiles, with the number of tunnels managed from each
+func (t *Tnnlr) ApiListProfiles(c *gin.Context) {
+	type profileView struct {
+		Name         string `json:"name"`
+		File         string `json:"file"`
+		Format       string `json:"format"`
+		Tunnels      int    `json:"tunnels"`
+		SourceStatus string `json:"sourceStatus,omitempty"`
+	}
+	profiles := []profileView{}
+	for _, p := range t.profiles {
+		profiles = append(profiles, profileView{
+			Name:         p.Name,
+			File:         p.File,
+			Format:       p.fileFormat(),
+			Tunnels:      len(t.ProfileTunnels(p.Name)),
+			SourceStatus: p.SourceStatus(),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"profiles": profiles})
+}
+
+// Look up the profile named in the request's path, responding with a 404 if there isn't one
+func (t *Tnnlr) apiProfile(c *gin.Context) (*Profile, bool) {
+	p, err := t.profile(c.Param("profile"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return p, true
+}
+
+// Save a profile's tunnels to its file
+func (t *Tnnlr) ApiSaveProfile(c *gin.Context) {
+	p, ok := t.apiProfile(c)
+	if !ok {
+		return
+	}
+	if err := t.SaveProfile(p); err != nil {
+		apiError(c, "Failed to write tunnel file", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"profile": p.Name, "file": p.File})
+}
+
+// Reload a profile from its file, responding with what was done to each tunnel
+// Responds with a 500 if any tunnel failed to start, with the reason on its action.
+func (t *Tnnlr) ApiReloadProfile(c *gin.Context) {
+	p, ok := t.apiProfile(c)
+	if !ok {
+		return
+	}
+	plan, err := t.ReloadTunnels(p)
+	if err != nil {
+		// A file that doesn't parse is as invalid as one with invalid tunnels
+		if _, ok := err.(ValidationErrors); !ok && !os.IsNotExist(err) {
+			err = ValidationErrors{{Index: -1, Message: err.Error()}}
+		}
+		apiError(c, "Failed to parse tunnels from file", err)
+		return
+	}
+
+	status := http.StatusOK
+	body := gin.H{"profile": p.Name, "file": p.File, "actions": plan}
+	for _, action := range plan {
+		if action.Error != "" {
+			status = http.StatusInternalServerError
+			body["error"] = "Failed to start some tunnels"
+			break
+		}
+	}
+	c.JSON(status, body)
+}
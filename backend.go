@@ -0,0 +1,167 @@
+package tnnlr
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+/*
+Backends are the different ways tnnlr can run a tunnel.
+
+Whatever the backend, the tunnel's pid file and logfile live in the usual bookkeeping dirs, so
+cleanup and restarts work the same way for all of them.
+*/
+
+// Backends for running tunnels
+const (
+	BackendSsh    = "ssh"    // exec the ssh client (default)
+	BackendNative = "native" // in-process, using golang.org/x/crypto/ssh
+	BackendExec   = "exec"   // exec a user supplied port forwarding command
+)
+
+type TunnelBackend interface {
+	// Launch the tunnel
+	// Returns once the tunnel has been started, not necessarily once it is forwarding
+	Start(t *Tunnel) error
+	// Stop the tunnel if it is running
+	Stop(t *Tunnel) error
+	// One of StatusStarting, StatusUp or StatusDead
+	Status(t *Tunnel) string
+	// A shell command that does the same as the tunnel, for display
+	Command(t *Tunnel) string
+	// Where the output of the tunnel is written
+	LogPath(t *Tunnel) (string, error)
+}
+
+// Runs tunnels with an ssh executable
+type sshBackend struct {
+	Exec   string // path to ssh executable
+	Detach bool   // leave tunnels running when tnnlr exits
+}
+
+func (b *sshBackend) Start(t *Tunnel) error {
+	return startProcess(t, b.Detach, b.Exec, append([]string{"-v"}, t.sshArgs()...)...)
+}
+
+func (b *sshBackend) Stop(t *Tunnel) error {
+	return stopProcess(t)
+}
+
+func (b *sshBackend) Status(t *Tunnel) string {
+	return processStatus(t)
+}
+
+func (b *sshBackend) Command(t *Tunnel) string {
+	return t.sshCommand()
+}
+
+func (b *sshBackend) LogPath(t *Tunnel) (string, error) {
+	return t.LogPath()
+}
+
+/*
+Runs tunnels with an arbitrary command, e.g. `kubectl port-forward` or `socat`.
+
+The command is a text/template rendered with the tunnel, so it can refer to fields like
+{{.LocalPort}}, {{.RemotePort}}, {{.Host}} and {{.RemoteHost}}. It is run with the system shell.
+*/
+type execBackend struct {
+	Detach bool // leave tunnels running when tnnlr exits
+}
+
+func (b *execBackend) Start(t *Tunnel) error {
+	cmdline, err := t.renderCommand()
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		return startProcess(t, b.Detach, "cmd", "/C", cmdline)
+	}
+	// exec so stopping the shell's pid stops the command itself
+	return startProcess(t, b.Detach, "sh", "-c", "exec "+cmdline)
+}
+
+func (b *execBackend) Stop(t *Tunnel) error {
+	return stopProcess(t)
+}
+
+func (b *execBackend) Status(t *Tunnel) string {
+	return processStatus(t)
+}
+
+func (b *execBackend) Command(t *Tunnel) string {
+	cmdline, err := t.renderCommand()
+	if err != nil {
+		return fmt.Sprintf("Invalid command template: %s", err.Error())
+	}
+	return cmdline
+}
+
+func (b *execBackend) LogPath(t *Tunnel) (string, error) {
+	return t.LogPath()
+}
+
+// Render the tunnel's command template
+func (t *Tunnel) renderCommand() (string, error) {
+	tmpl, err := template.New("command").Option("missingkey=error").Parse(t.Command)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err = tmpl.Execute(&b, t); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// Start a process for the tunnel, with output going to the tunnel's logfile
+// Detached processes keep running after tnnlr exits, and are adopted by the next tnnlr to start.
+func startProcess(t *Tunnel, detach bool, name string, args ...string) error {
+	// Set up logging and launch task
+	logPath, err := t.LogPath()
+	if err != nil {
+		return err
+	}
+	logOut, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	// The child has its own copy of the file once started
+	defer logOut.Close()
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = logOut
+	cmd.Stderr = logOut
+	if detach {
+		cmd.SysProcAttr = detachAttr()
+	}
+	proc, err := startChild(cmd)
+	if err != nil {
+		return err
+	}
+	t.proc = proc
+	t.Pid = proc.Pid()
+
+	return t.writePidFile()
+}
+
+// Stop the tunnel's process
+func stopProcess(t *Tunnel) error {
+	if t.proc == nil {
+		return nil
+	}
+	return t.proc.Stop(stopGracePeriod)
+}
+
+// The status of a tunnel run as a child process
+func processStatus(t *Tunnel) string {
+	if t.proc == nil || t.proc.Exited() {
+		return StatusDead
+	}
+	return t.runningStatus()
+}
@@ -0,0 +1,175 @@
+package tnnlr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A stub forwarding command: prints the port it was given, then runs until the stop file shows up
+const execStubScript = `#!/bin/sh
+echo "forwarding $1"
+while [ ! -e "$2" ]; do
+    sleep 0.1
+done
+echo "stopping"
+`
+
+// Point bookkeeping at a temporary directory, returning a function to clean up
+func useTempBaseDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "tnnlr-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := baseDir
+	baseDir = dir
+	for _, sub := range []string{relProc, relLog} {
+		if err := createRelDir(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, func() {
+		baseDir = old
+		os.RemoveAll(dir)
+	}
+}
+
+// A local port nothing is listening on
+func freePort(t *testing.T) int32 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return int32(l.Addr().(*net.TCPAddr).Port)
+}
+
+func waitForStatus(t *testing.T, tnnl *Tunnel, want string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for tnnl.Status() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Tunnel status is '%s', expected '%s'", tnnl.Status(), want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// An exec tunnel running the stub, and the file that makes the stub exit
+func execStubTunnel(t *testing.T, dir string) (*Tunnel, string) {
+	script := filepath.Join(dir, "stub forward.sh")
+	if err := ioutil.WriteFile(script, []byte(execStubScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stopFile := filepath.Join(dir, "stop")
+	return &Tunnel{
+		Id:          "exec-test",
+		Name:        "stub",
+		Host:        "example.com",
+		Backend:     BackendExec,
+		Command:     fmt.Sprintf("%s {{.LocalPort}} %s", shellQuote(script), shellQuote(stopFile)),
+		BindAddress: "127.0.0.1",
+		LocalPort:   freePort(t),
+		RemotePort:  80,
+	}, stopFile
+}
+
+func TestExecBackend(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The stub command is a shell script")
+	}
+	dir, cleanup := useTempBaseDir(t)
+	defer cleanup()
+	tnnl, stopFile := execStubTunnel(t, dir)
+
+	if err := tnnl.Run(&execBackend{}); err != nil {
+		t.Fatalf("Failed to start tunnel: %s", err)
+	}
+	defer tnnl.Stop()
+	if tnnl.Pid == 0 {
+		t.Fatal("Tunnel has no pid once started")
+	}
+
+	// The pid file records the process and who manages it
+	pidPath, _ := tnnl.PidPath()
+	recorded, owner, err := readPidFile(pidPath)
+	if err != nil {
+		t.Fatalf("Failed to read pid file: %s", err)
+	}
+	if recorded.Pid != tnnl.Pid || recorded.Backend != BackendExec {
+		t.Errorf("Pid file has pid %d and backend '%s', expected %d and '%s'", recorded.Pid, recorded.Backend, tnnl.Pid, BackendExec)
+	}
+	if owner != os.Getpid() {
+		t.Errorf("Pid file has owner %d, expected %d", owner, os.Getpid())
+	}
+
+	// Up once something listens on the local port, which the stub leaves to the test
+	waitForStatus(t, tnnl, StatusStarting)
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", tnnl.LocalPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	waitForStatus(t, tnnl, StatusUp)
+
+	// Dead once the command exits
+	if err := ioutil.WriteFile(stopFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, tnnl, StatusDead)
+	if !tnnl.exitedCleanly() {
+		t.Error("Stub exited with an error")
+	}
+
+	logPath, _ := tnnl.LogPath()
+	output, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %s", err)
+	}
+	if expected := fmt.Sprintf("forwarding %d\nstopping\n", tnnl.LocalPort); string(output) != expected {
+		t.Errorf("Log file has %q, expected %q", output, expected)
+	}
+
+	if err := tnnl.Stop(); err != nil {
+		t.Errorf("Failed to stop dead tunnel: %s", err)
+	}
+	if _, err := os.Stat(pidPath); !os.IsNotExist(err) {
+		t.Error("Pid file is left after stopping")
+	}
+}
+
+func TestExecBackendStop(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The stub command is a shell script")
+	}
+	dir, cleanup := useTempBaseDir(t)
+	defer cleanup()
+	tnnl, _ := execStubTunnel(t, dir)
+
+	if err := tnnl.Run(&execBackend{}); err != nil {
+		t.Fatalf("Failed to start tunnel: %s", err)
+	}
+	waitForStatus(t, tnnl, StatusStarting)
+	pid := tnnl.Pid
+
+	if err := tnnl.Stop(); err != nil {
+		t.Fatalf("Failed to stop tunnel: %s", err)
+	}
+	if status := tnnl.Status(); status != StatusDead {
+		t.Errorf("Tunnel status is '%s' after stopping, expected '%s'", status, StatusDead)
+	}
+	pidPath, _ := tnnl.PidPath()
+	if _, err := os.Stat(pidPath); !os.IsNotExist(err) {
+		t.Error("Pid file is left after stopping")
+	}
+	if pidRunning(pid, func(cmdline []string) bool {
+		return strings.Contains(strings.Join(cmdline, " "), "stub forward.sh")
+	}) {
+		t.Errorf("Stub is still running as pid %d", pid)
+	}
+}
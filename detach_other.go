@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package tnnlr
+
+import "syscall"
+
+// Run the process in its own session, so it doesn't get the terminal's signals and outlives tnnlr
+func detachAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,8 @@
+package tnnlr
+
+import "syscall"
+
+// Run the process in its own process group, so it doesn't get the console's Ctrl-C
+func detachAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
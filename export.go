@@ -0,0 +1,513 @@
+package tnnlr
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Exporting tunnels to run without tnnlr.
+
+Tunnels can be exported as the commands they run, a Host block each for `~/.ssh/config`, a bash
+script that runs them all, or a systemd user unit or launchd agent each. Exec tunnels run their
+command everywhere except in ssh config, which can only describe ssh connections.
+*/
+
+// Export formats
+const (
+	ExportCommand   = "command"    // the command each tunnel runs, as shown by "Show command"
+	ExportSshConfig = "ssh_config" // a Host block per tunnel
+	ExportBash      = "bash"       // a script running every tunnel until it's stopped
+	ExportSystemd   = "systemd"    // a systemd user unit per tunnel
+	ExportLaunchd   = "launchd"    // a launchd agent per tunnel
+)
+
+var ExportFormats = []string{ExportCommand, ExportSshConfig, ExportBash, ExportSystemd, ExportLaunchd}
+
+// Exported ssh config hosts are named with this prefix, so they don't clash with the user's own
+const sshConfigHostPrefix = "tnnlr-"
+
+// The labels of launchd agents are this followed by the tunnel's name
+const launchdLabelPrefix = "com.github.turtlemonvh.tnnlr."
+
+// A file written by an export
+type ExportedFile struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+// Export tunnels in one of the export formats
+// Tunnels are sorted by name so the same tunnels always export the same way.
+func ExportTunnels(tunnels []*Tunnel, format, sshExec string) ([]ExportedFile, error) {
+	sorted := append([]*Tunnel(nil), tunnels...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	names := exportNames(sorted)
+
+	var files []ExportedFile
+	switch format {
+	case ExportCommand:
+		var b bytes.Buffer
+		for _, tnnl := range sorted {
+			fmt.Fprintln(&b, tnnl.getCommand())
+		}
+		files = append(files, ExportedFile{"tnnlr-commands.txt", "text/plain; charset=utf-8", b.Bytes()})
+	case ExportSshConfig:
+		files = append(files, ExportedFile{"tnnlr.ssh_config", "text/plain; charset=utf-8", exportSshConfig(sorted, names)})
+	case ExportBash:
+		content, err := exportBash(sorted, sshExec)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ExportedFile{"tnnlr-tunnels.sh", "text/x-shellscript; charset=utf-8", content})
+	case ExportSystemd:
+		for _, tnnl := range sorted {
+			content, err := exportSystemdUnit(tnnl, absoluteSshExec(sshExec))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, ExportedFile{fmt.Sprintf("tnnlr-%s.service", names[tnnl]), "text/plain; charset=utf-8", content})
+		}
+	case ExportLaunchd:
+		for _, tnnl := range sorted {
+			content, err := exportLaunchdAgent(tnnl, names[tnnl], absoluteSshExec(sshExec))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, ExportedFile{launchdLabelPrefix + names[tnnl] + ".plist", "application/xml", content})
+		}
+	default:
+		return nil, fmt.Errorf("Unknown export format '%s', options are: [%s]", format, strings.Join(ExportFormats, ","))
+	}
+	return files, nil
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// A name made safe for file names, unit names and ssh config hosts
+func exportSafe(name string) string {
+	return strings.Trim(unsafeNameChars.ReplaceAllString(name, "-"), "-.")
+}
+
+// The tunnel's name, made safe for file names, unit names and ssh config hosts
+func exportName(t *Tunnel) string {
+	if name := exportSafe(t.Name); name != "" {
+		return name
+	}
+	return exportSafe(t.Id)
+}
+
+// Unique export names for the tunnels
+// Tunnels whose names come out the same get the end of their id added, ignoring case since launchd
+// agents usually live on a case insensitive file system.
+func exportNames(tunnels []*Tunnel) map[*Tunnel]string {
+	counts := make(map[string]int)
+	for _, tnnl := range tunnels {
+		counts[strings.ToLower(exportName(tnnl))]++
+	}
+	names := make(map[*Tunnel]string)
+	used := make(map[string]bool)
+	for _, tnnl := range tunnels {
+		name := exportName(tnnl)
+		if id := exportSafe(tnnl.Id); counts[strings.ToLower(name)] > 1 && id != "" && id != name {
+			if len(id) > 6 {
+				id = id[len(id)-6:]
+			}
+			name = fmt.Sprintf("%s-%s", name, id)
+		}
+		// Ids can clash too, or be missing
+		unique := name
+		for i := 2; used[strings.ToLower(unique)]; i++ {
+			unique = fmt.Sprintf("%s-%d", name, i)
+		}
+		used[strings.ToLower(unique)] = true
+		names[tnnl] = unique
+	}
+	return names
+}
+
+// An absolute path to ssh, since systemd and launchd don't search the PATH like a shell
+func absoluteSshExec(sshExec string) string {
+	if filepath.IsAbs(sshExec) {
+		return sshExec
+	}
+	if path, err := exec.LookPath(sshExec); err == nil && filepath.IsAbs(path) {
+		return path
+	}
+	return "/usr/bin/ssh"
+}
+
+// The command line that runs the tunnel outside of tnnlr
+// Exec tunnels run their command through the shell, and every other tunnel runs ssh.
+func (t *Tunnel) exportArgs(sshExec string) ([]string, error) {
+	if t.Backend == BackendExec {
+		cmdline, err := t.renderCommand()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid command template for tunnel '%s': %s", t.Name, err.Error())
+		}
+		return []string{"/bin/sh", "-c", "exec " + cmdline}, nil
+	}
+	return append([]string{sshExec}, t.sshArgs()...), nil
+}
+
+// A Host block per tunnel, to paste into ~/.ssh/config
+// The tunnel's host is written as the HostName, so if it's an alias from elsewhere in the ssh config
+// that alias isn't followed.
+func exportSshConfig(tunnels []*Tunnel, names map[*Tunnel]string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "# Tunnels exported from tnnlr")
+	fmt.Fprintf(&b, "# Start a tunnel with `ssh -N %s<name>`\n", sshConfigHostPrefix)
+	for _, tnnl := range tunnels {
+		fmt.Fprintln(&b)
+		if tnnl.Backend == BackendExec {
+			fmt.Fprintf(&b, "# %s runs a command instead of ssh, so it can't be written as ssh config\n", tnnl.Name)
+			continue
+		}
+		// Hosts for the native backend can include the port
+		host, port := tnnl.Host, ""
+		if h, p, err := net.SplitHostPort(tnnl.Host); err == nil {
+			host, port = h, p
+		}
+
+		fmt.Fprintf(&b, "# %s\n", tnnl.Name)
+		fmt.Fprintf(&b, "Host %s%s\n", sshConfigHostPrefix, names[tnnl])
+		fmt.Fprintf(&b, "    HostName %s\n", sshConfigQuote(host))
+		if port != "" {
+			fmt.Fprintf(&b, "    Port %s\n", port)
+		}
+		if tnnl.Username != "" {
+			fmt.Fprintf(&b, "    User %s\n", sshConfigQuote(tnnl.Username))
+		}
+		if tnnl.IdentityFile != "" {
+			fmt.Fprintf(&b, "    IdentityFile %s\n", sshConfigQuote(tnnl.IdentityFile))
+		}
+		if len(tnnl.JumpHosts) > 0 {
+			fmt.Fprintf(&b, "    ProxyJump %s\n", sshConfigQuote(strings.Join(tnnl.JumpHosts, ",")))
+		}
+		unlinkSockets := false
+		for _, f := range tnnl.AllForwards() {
+			fmt.Fprintf(&b, "    %s\n", f.sshConfigOption(tnnl.Kind()))
+			unlinkSockets = unlinkSockets || f.usesSockets()
+		}
+		if unlinkSockets {
+			fmt.Fprintln(&b, "    StreamLocalBindUnlink yes")
+		}
+		fmt.Fprintln(&b, "    ExitOnForwardFailure yes")
+	}
+	return b.Bytes()
+}
+
+// Quote a value in ssh config, which splits values on whitespace
+func sshConfigQuote(s string) string {
+	if !strings.ContainsAny(s, " \t\"") {
+		return s
+	}
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// Quote a word for the shell
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// A script that runs every tunnel in the background, and stops them all when it exits
+func exportBash(tunnels []*Tunnel, sshExec string) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "#!/usr/bin/env bash")
+	fmt.Fprintln(&b, "# Tunnels exported from tnnlr")
+	fmt.Fprintln(&b, "# Runs every tunnel until this script is stopped, e.g. with Ctrl-C")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, `trap 'kill $(jobs -p) 2>/dev/null' EXIT`)
+	for _, tnnl := range tunnels {
+		fmt.Fprintln(&b)
+		fmt.Fprintf(&b, "# %s\n", tnnl.Name)
+		if tnnl.Backend == BackendExec {
+			cmdline, err := tnnl.renderCommand()
+			if err != nil {
+				return nil, fmt.Errorf("Invalid command template for tunnel '%s': %s", tnnl.Name, err.Error())
+			}
+			fmt.Fprintf(&b, "%s &\n", cmdline)
+			continue
+		}
+		args, _ := tnnl.exportArgs(sshExec)
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = shellQuote(arg)
+		}
+		fmt.Fprintf(&b, "%s &\n", strings.Join(quoted, " "))
+	}
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "wait")
+	return b.Bytes(), nil
+}
+
+// Quote an argument for a systemd unit's command line
+func systemdQuote(s string) string {
+	// Specifiers and environment variables would otherwise be expanded
+	s = strings.Replace(s, "%", "%%", -1)
+	s = strings.Replace(s, "$", "$$", -1)
+	if !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// A systemd user unit for the tunnel, for `~/.config/systemd/user`
+func exportSystemdUnit(t *Tunnel, sshExec string) ([]byte, error) {
+	args, err := t.exportArgs(sshExec)
+	if err != nil {
+		return nil, err
+	}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = systemdQuote(arg)
+	}
+	restart := map[string]string{
+		RestartAlways:    "always",
+		RestartOnFailure: "on-failure",
+		RestartNever:     "no",
+	}[t.restartPolicy()]
+	restartSec := t.RestartBackoff
+	if restartSec == 0 {
+		restartSec = defaultRestartBackoff
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "# Tunnel exported from tnnlr")
+	fmt.Fprintln(&b, "[Unit]")
+	// Specifiers are expanded in the description too
+	fmt.Fprintf(&b, "Description=tnnlr tunnel %s\n", strings.Replace(t.Name, "%", "%%", -1))
+	fmt.Fprintln(&b, "After=network-online.target")
+	fmt.Fprintln(&b, "Wants=network-online.target")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "[Service]")
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(quoted, " "))
+	fmt.Fprintf(&b, "Restart=%s\n", restart)
+	fmt.Fprintf(&b, "RestartSec=%d\n", restartSec)
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "[Install]")
+	fmt.Fprintln(&b, "WantedBy=default.target")
+	return b.Bytes(), nil
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// A launchd agent for the tunnel, for `~/Library/LaunchAgents`
+func exportLaunchdAgent(t *Tunnel, name, sshExec string) ([]byte, error) {
+	args, err := t.exportArgs(sshExec)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintln(&b, `<?xml version="1.0" encoding="UTF-8"?>`)
+	fmt.Fprintln(&b, `<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">`)
+	fmt.Fprintln(&b, `<!-- Tunnel exported from tnnlr -->`)
+	fmt.Fprintln(&b, `<plist version="1.0">`)
+	fmt.Fprintln(&b, `<dict>`)
+	fmt.Fprintln(&b, `    <key>Label</key>`)
+	fmt.Fprintf(&b, "    <string>%s</string>\n", xmlEscape(launchdLabelPrefix+name))
+	fmt.Fprintln(&b, `    <key>ProgramArguments</key>`)
+	fmt.Fprintln(&b, `    <array>`)
+	for _, arg := range args {
+		fmt.Fprintf(&b, "        <string>%s</string>\n", xmlEscape(arg))
+	}
+	fmt.Fprintln(&b, `    </array>`)
+	fmt.Fprintln(&b, `    <key>RunAtLoad</key>`)
+	fmt.Fprintln(&b, `    <true/>`)
+	fmt.Fprintln(&b, `    <key>KeepAlive</key>`)
+	switch t.restartPolicy() {
+	case RestartOnFailure:
+		fmt.Fprintln(&b, `    <dict>`)
+		fmt.Fprintln(&b, `        <key>SuccessfulExit</key>`)
+		fmt.Fprintln(&b, `        <false/>`)
+		fmt.Fprintln(&b, `    </dict>`)
+	case RestartNever:
+		fmt.Fprintln(&b, `    <false/>`)
+	default:
+		fmt.Fprintln(&b, `    <true/>`)
+	}
+	if t.RestartBackoff > 0 {
+		fmt.Fprintln(&b, `    <key>ThrottleInterval</key>`)
+		fmt.Fprintf(&b, "    <integer>%d</integer>\n", t.RestartBackoff)
+	}
+	fmt.Fprintln(&b, `</dict>`)
+	fmt.Fprintln(&b, `</plist>`)
+	return b.Bytes(), nil
+}
+
+// Bundle exported files into a zip archive
+func zipExport(files []ExportedFile) ([]byte, error) {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for _, file := range files {
+		f, err := w.Create(file.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(file.Content); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Download a profile's tunnels in one of the export formats
+// Only the tunnels listed with `id` are exported, or all of them if there are none. Formats with a
+// file per tunnel are downloaded as a zip archive when there is more than one.
+func (t *Tnnlr) Export(c *gin.Context) {
+	p, err := t.requestProfile(c)
+	if err != nil {
+		t.AddMessage(err.Error())
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	var tunnels []*Tunnel
+	managed := t.ProfileTunnels(p.Name)
+	ids := c.QueryArray("id")
+	for _, tnnlId := range ids {
+		if tnnl, ok := managed[tnnlId]; ok {
+			tunnels = append(tunnels, tnnl)
+		}
+	}
+	if len(ids) == 0 {
+		for _, tnnl := range managed {
+			tunnels = append(tunnels, tnnl)
+		}
+	}
+
+	format := c.DefaultQuery("format", ExportBash)
+	files, err := ExportTunnels(tunnels, format, t.SshExec)
+	if err != nil {
+		message := "Failed to export tunnels"
+		log.WithFields(log.Fields{
+			"err":     err.Error(),
+			"format":  format,
+			"profile": p.Name,
+		}).Error(message)
+		t.AddMessage(fmt.Sprintf("%s: %s", message, err.Error()))
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	var file ExportedFile
+	switch len(files) {
+	case 0:
+		t.AddMessage(fmt.Sprintf("No tunnels to export from profile '%s'", p.Name))
+		c.Redirect(http.StatusFound, "/")
+		return
+	case 1:
+		file = files[0]
+	default:
+		content, err := zipExport(files)
+		if err != nil {
+			message := "Failed to export tunnels"
+			log.WithFields(log.Fields{
+				"err": err.Error(),
+			}).Error(message)
+			t.AddMessage(message)
+			c.Redirect(http.StatusFound, "/")
+			return
+		}
+		file = ExportedFile{fmt.Sprintf("tnnlr-%s-%s.zip", p.Name, format), "application/zip", content}
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, file.Name))
+	c.Data(http.StatusOK, file.ContentType, file.Content)
+}
+
+// Export the tunnels of a profile's file, writing the files to the output dir, or to out if output
+// is "" and the export is a single file
+// Only the tunnels named are exported, or all of them if there are none. This runs without a
+// server, so tunnels are exported as they are defined rather than as they are running.
+func (t *Tnnlr) ExportToFiles(out io.Writer, profile, format string, names []string, output string) error {
+	p, err := t.commandProfile(profile)
+	if err != nil {
+		return err
+	}
+	tmpTunnels, err := p.Load()
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+	var tunnels []*Tunnel
+	for i := range tmpTunnels {
+		if len(names) == 0 || wanted[tmpTunnels[i].Name] {
+			tunnels = append(tunnels, &tmpTunnels[i])
+			delete(wanted, tmpTunnels[i].Name)
+		}
+	}
+	if len(wanted) > 0 {
+		var missing []string
+		for name := range wanted {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("No tunnel named '%s' in %s", strings.Join(missing, "', '"), p.File)
+	}
+	if t.SshExec == "" {
+		t.SshExec = "ssh"
+	}
+	files, err := ExportTunnels(tunnels, format, t.SshExec)
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		if len(files) != 1 {
+			return fmt.Errorf("Exporting as %s writes %d files, use --output to pick a directory for them", format, len(files))
+		}
+		_, err = out.Write(files[0].Content)
+		return err
+	}
+	if err := os.MkdirAll(output, 0755); err != nil {
+		return err
+	}
+	for _, file := range files {
+		mode := os.FileMode(0644)
+		if format == ExportBash {
+			mode = 0755
+		}
+		path := filepath.Join(output, file.Name)
+		if err := ioutil.WriteFile(path, file.Content, mode); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Wrote %s\n", path)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package tnnlr
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Tunnels of every type and backend, with names and paths that need quoting, and names that clash
+func exportTestTunnels() []*Tunnel {
+	return []*Tunnel{
+		{Id: "1", Name: "web", Host: "example.com", Username: "me", LocalPort: 8080, RemotePort: 80, DefaultUrl: "/"},
+		{
+			Id: "2", Name: "db behind bastion", Host: "db.example.com:2222", Username: "me",
+			IdentityFile: "/home/me/.ssh/work key", JumpHosts: []string{"bastion", "me@jump.example.com:2200"},
+			BindAddress: "127.0.0.1", LocalPort: 5432, RemoteHost: "postgres.internal", RemotePort: 5432,
+			Restart: RestartOnFailure, RestartBackoff: 5,
+		},
+		{Id: "3", Name: "expose dev server", Type: TunnelTypeRemote, Host: "example.com", LocalPort: 3000, RemotePort: 9000, Restart: RestartNever},
+		{Id: "4", Name: "socks", Type: TunnelTypeDynamic, Host: "example.com", LocalPort: 1080},
+		{
+			Id: "5", Name: "several", Host: "example.com", LocalPort: 6379, RemotePort: 6379, DefaultUrl: "/",
+			Forwards: []Forward{
+				{LocalPort: 9200, RemotePort: 9200},
+				{LocalSocket: "/tmp/remote docker.sock", RemoteSocket: "/var/run/docker.sock"},
+			},
+		},
+		{
+			Id: "6", Name: `grafana "prod"`, Backend: BackendExec, Host: "prod", LocalPort: 3001, RemotePort: 80, DefaultUrl: "/",
+			Command: `kubectl port-forward svc/grafana {{.LocalPort}}:{{.RemotePort}} --context "it's prod"`,
+		},
+		{Id: "7", Name: "it's 100% $HOME", Host: "example.com", IdentityFile: `/keys/it's "a" key`, LocalPort: 8081, RemotePort: 80, DefaultUrl: "/"},
+		{Id: "5a8f3c2e9b1d4e7f6a0b2c3d", Name: "Web", Host: "example.com", LocalPort: 8082, RemotePort: 80},
+	}
+}
+
+func TestExportTunnels(t *testing.T) {
+	cases := []struct {
+		format string
+		golden string
+	}{
+		{ExportCommand, "export_command.golden"},
+		{ExportSshConfig, "export_ssh_config.golden"},
+		{ExportBash, "export_bash.golden"},
+		{ExportSystemd, "export_systemd.golden"},
+		{ExportLaunchd, "export_launchd.golden"},
+	}
+	for _, c := range cases {
+		t.Run(c.format, func(t *testing.T) {
+			files, err := ExportTunnels(exportTestTunnels(), c.format, "/usr/bin/ssh")
+			if err != nil {
+				t.Fatalf("Export failed: %s", err)
+			}
+			var got bytes.Buffer
+			for _, f := range files {
+				fmt.Fprintf(&got, "==> %s (%s) <==\n", f.Name, f.ContentType)
+				got.Write(f.Content)
+			}
+
+			path := filepath.Join("testdata", c.golden)
+			if *update {
+				if err := ioutil.WriteFile(path, got.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("Export doesn't match %s, run `go test -update` if the change is expected\ngot:\n%s\nwant:\n%s", path, got.Bytes(), want)
+			}
+		})
+	}
+}
+
+func TestExportTunnelsUnknownFormat(t *testing.T) {
+	if _, err := ExportTunnels(exportTestTunnels(), "csv", "/usr/bin/ssh"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
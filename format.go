@@ -0,0 +1,349 @@
+package tnnlr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	toml "github.com/pelletier/go-toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+/*
+Reading and writing the tunnels file as json, yaml or toml.
+
+All three use the same field names. yaml files are a list of tunnels like json files, while toml
+files list them as `[[tunnels]]` tables. json and yaml files that define variables (see vars.go)
+or a source (see source.go) are an object with `variables`, `source` and `tunnels` keys instead.
+
+Neither yaml nor toml libraries keep comments, so they are carried over by hand when saving: the
+comment block at the top of the file, and the comments just above each tunnel, matched by the
+tunnel's name. Comments between the fields of a tunnel, or at the end of a line, are lost.
+*/
+
+// Tunnels file formats
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// The tunnels file as a whole
+// A toml document has to be a table, so toml files always have this form.
+type tunnelsFile struct {
+	Variables map[string]string `json:"variables,omitempty" yaml:"variables,omitempty" toml:"variables,omitempty"`
+	Source    *Source           `json:"source,omitempty" yaml:"source,omitempty" toml:"source,omitempty"`
+	Tunnels   []Tunnel          `json:"tunnels" yaml:"tunnels" toml:"tunnels"`
+}
+
+// Whether the file has to be written as an object rather than a plain list of tunnels
+func (doc tunnelsFile) needsObjectForm() bool {
+	return len(doc.Variables) > 0 || doc.Source != nil
+}
+
+func validateFormat(format string) error {
+	switch format {
+	case "", FormatJSON, FormatYAML, FormatTOML:
+		return nil
+	}
+	return fmt.Errorf("Unknown tunnels file format '%s'", format)
+}
+
+// Whether a json or yaml file is an object with tunnels and variables, rather than a list of tunnels
+func isObjectForm(raw []byte, format string) bool {
+	var doc interface{}
+	if format == FormatYAML {
+		yaml.Unmarshal(raw, &doc)
+		_, ok := doc.(map[interface{}]interface{})
+		return ok
+	}
+	json.Unmarshal(raw, &doc)
+	_, ok := doc.(map[string]interface{})
+	return ok
+}
+
+// Decode a tunnels file, without expanding variables
+func decodeTunnelsFile(raw []byte, format string) (tunnelsFile, error) {
+	var doc tunnelsFile
+	var err error
+	switch {
+	case format == FormatTOML:
+		err = toml.Unmarshal(raw, &doc)
+	case format == FormatYAML && isObjectForm(raw, format):
+		err = yaml.Unmarshal(raw, &doc)
+	case format == FormatYAML:
+		err = yaml.Unmarshal(raw, &doc.Tunnels)
+	case isObjectForm(raw, format):
+		err = json.Unmarshal(raw, &doc)
+	default:
+		err = json.Unmarshal(raw, &doc.Tunnels)
+	}
+	return doc, err
+}
+
+// Encode tunnels as a tunnels file, keeping the variables and source of the existing file
+// This is a plain list unless there are variables or a source to keep.
+func encodeTunnels(tunnels []*Tunnel, existing tunnelsFile, format string) ([]byte, error) {
+	doc := tunnelsFile{
+		Variables: existing.Variables,
+		Source:    existing.Source,
+		Tunnels:   []Tunnel{},
+	}
+	for _, tnnl := range tunnels {
+		doc.Tunnels = append(doc.Tunnels, *tnnl)
+	}
+	switch {
+	case format == FormatTOML:
+		return toml.Marshal(doc)
+	case format == FormatYAML && doc.needsObjectForm():
+		return yaml.Marshal(doc)
+	case format == FormatYAML:
+		return yaml.Marshal(tunnels)
+	}
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetIndent("", "  ")
+	var err error
+	if doc.needsObjectForm() {
+		err = encoder.Encode(doc)
+	} else {
+		err = encoder.Encode(tunnels)
+	}
+	return b.Bytes(), err
+}
+
+// Comments and tunnel order from a tunnels file, to keep when saving
+type fileComments struct {
+	header  []string            // comment block at the top of the file
+	tunnels map[string][]string // comment lines just above each tunnel, by tunnel name
+	order   map[string]int      // the position of each tunnel in the file, by name
+}
+
+var (
+	yamlNameLine = regexp.MustCompile(`^\s*(?:- )?\s*name:\s*(.*?)\s*$`)
+	tomlNameLine = regexp.MustCompile(`^\s*name\s*=\s*(.*?)\s*$`)
+)
+
+// Whether a line starts a new tunnel
+// yaml tunnels are list items at the given indentation.
+func isTunnelStart(line, format, indent string) bool {
+	if format == FormatTOML {
+		return strings.TrimSpace(line) == "[[tunnels]]"
+	}
+	return line == indent+"-" || strings.HasPrefix(line, indent+"- ")
+}
+
+// The indentation of the tunnels in a yaml file
+// This is "" for a plain list, but the list under `tunnels` may be indented.
+func yamlTunnelIndent(lines []string) string {
+	for i, line := range lines {
+		if strings.TrimRight(line, " ") != "tunnels:" {
+			continue
+		}
+		for _, item := range lines[i+1:] {
+			trimmed := strings.TrimLeft(item, " ")
+			if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+				return item[:len(item)-len(trimmed)]
+			}
+		}
+	}
+	return ""
+}
+
+// The tunnel name set on a line, if any
+func tunnelNameOnLine(line, format string) (string, bool) {
+	re := yamlNameLine
+	if format == FormatTOML {
+		re = tomlNameLine
+	}
+	m := re.FindStringSubmatch(line)
+	if m == nil {
+		return "", false
+	}
+	return strings.Trim(m[1], `"'`), true
+}
+
+// Split a yaml or toml file into the lines before the first tunnel, and the lines of each tunnel
+func splitTunnelBlocks(raw []byte, format string) ([]string, [][]string) {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	indent := ""
+	if format == FormatYAML {
+		indent = yamlTunnelIndent(lines)
+	}
+
+	var before []string
+	var blocks [][]string
+	for _, line := range lines {
+		switch {
+		case isTunnelStart(line, format, indent):
+			blocks = append(blocks, []string{line})
+		case len(blocks) == 0:
+			before = append(before, line)
+		default:
+			blocks[len(blocks)-1] = append(blocks[len(blocks)-1], line)
+		}
+	}
+	return before, blocks
+}
+
+// The name of the tunnel in a block from `splitTunnelBlocks`
+func blockName(block []string, format string) string {
+	for _, line := range block {
+		// Forwards of toml tunnels are separate tables, and don't have names
+		if format == FormatTOML && strings.HasPrefix(strings.TrimSpace(line), "[") && line != block[0] {
+			break
+		}
+		if name, ok := tunnelNameOnLine(line, format); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// The comment lines at the end of a set of lines, skipping trailing blank lines
+func trailingComments(lines []string) []string {
+	end := len(lines)
+	for end > 0 && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+	start := end
+	for start > 0 && strings.HasPrefix(strings.TrimSpace(lines[start-1]), "#") {
+		start--
+	}
+	return lines[start:end]
+}
+
+func isBlank(lines []string) bool {
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Pick out the comments and tunnel order of a tunnels file
+// Comments above the first tunnel belong to the header, unless they are separated from the rest of
+// the header by a blank line and sit right above the tunnel.
+func parseComments(raw []byte, format string) fileComments {
+	fc := fileComments{
+		tunnels: make(map[string][]string),
+		order:   make(map[string]int),
+	}
+	if format != FormatYAML && format != FormatTOML {
+		// No comments, but the order is still worth keeping
+		doc, _ := decodeTunnelsFile(raw, format)
+		for i, tnnl := range doc.Tunnels {
+			if _, ok := fc.order[tnnl.Name]; !ok {
+				fc.order[tnnl.Name] = i
+			}
+		}
+		return fc
+	}
+	before, blocks := splitTunnelBlocks(raw, format)
+
+	// yaml document markers are written by the encoder if needed, and aren't part of the header
+	var header, rest []string
+	for i, line := range before {
+		trimmed := strings.TrimSpace(line)
+		if format == FormatYAML && trimmed == "---" {
+			continue
+		}
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			// Variables come before the tunnels
+			rest = before[i:]
+			break
+		}
+		header = append(header, line)
+	}
+	for len(header) > 0 && strings.TrimSpace(header[len(header)-1]) == "" {
+		header = header[:len(header)-1]
+	}
+	if len(blocks) > 0 && len(rest) > 0 {
+		if comments := trailingComments(rest); len(comments) > 0 {
+			fc.tunnels[blockName(blocks[0], format)] = comments
+		}
+	} else if len(blocks) > 0 {
+		tunnelComments := trailingComments(header)
+		if start := len(header) - len(tunnelComments); start > 0 && isBlank(header[start-1:start]) {
+			fc.tunnels[blockName(blocks[0], format)] = tunnelComments
+			header = header[:start]
+		}
+	}
+	for len(header) > 0 && strings.TrimSpace(header[len(header)-1]) == "" {
+		header = header[:len(header)-1]
+	}
+	fc.header = header
+
+	for i, block := range blocks {
+		name := blockName(block, format)
+		if _, ok := fc.order[name]; !ok {
+			fc.order[name] = i
+		}
+		if i+1 < len(blocks) {
+			if comments := trailingComments(block); len(comments) > 0 {
+				fc.tunnels[blockName(blocks[i+1], format)] = comments
+			}
+		}
+	}
+	return fc
+}
+
+// Sort tunnels into the order they appear in the file, followed by new tunnels sorted by name
+func (fc fileComments) sortTunnels(tunnels []*Tunnel) {
+	sort.SliceStable(tunnels, func(i, j int) bool {
+		pi, iOk := fc.order[tunnels[i].Name]
+		pj, jOk := fc.order[tunnels[j].Name]
+		switch {
+		case iOk && jOk:
+			return pi < pj
+		case iOk != jOk:
+			return iOk
+		}
+		return tunnels[i].Name < tunnels[j].Name
+	})
+}
+
+// Add comments from `parseComments` back into a freshly encoded yaml or toml file
+func (fc fileComments) apply(encoded []byte, format string) []byte {
+	if format != FormatYAML && format != FormatTOML {
+		return encoded
+	}
+	before, blocks := splitTunnelBlocks(encoded, format)
+
+	var lines []string
+	lines = append(lines, fc.header...)
+	if len(fc.header) > 0 {
+		lines = append(lines, "")
+	}
+	for _, line := range before {
+		if strings.TrimSpace(line) != "" || len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+			lines = append(lines, line)
+		}
+	}
+	for i, block := range blocks {
+		if comments := fc.tunnels[blockName(block, format)]; len(comments) > 0 {
+			if i > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+				lines = append(lines, "")
+			}
+			// Line the comments up with the tunnel, which may be indented differently than before
+			indent := block[0][:len(block[0])-len(strings.TrimLeft(block[0], " "))]
+			for _, comment := range comments {
+				lines = append(lines, indent+strings.TrimSpace(comment))
+			}
+		}
+		lines = append(lines, block...)
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
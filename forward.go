@@ -0,0 +1,298 @@
+package tnnlr
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The highest valid port number
+const maxPort = 65535
+
+// A single port forward
+// A tunnel's own port fields describe its first forward, and any others are listed in `Tunnel.Forwards`.
+// All forwards of a tunnel are carried by the same ssh process.
+// Either end of a forward can be a unix socket path instead of a port.
+type Forward struct {
+	// The local address to listen on, e.g. "0.0.0.0" to expose the forward to your network
+	// For remote tunnels this is the local address connections are sent to instead
+	// Defaults to the tunnel's bind address
+	BindAddress string `json:"bindAddress,omitempty" yaml:"bindAddress,omitempty" toml:"bindAddress,omitempty"`
+	LocalPort   int32  `json:"localPort,omitempty" yaml:"localPort,omitempty" toml:"localPort,omitempty"`
+	LocalSocket string `json:"localSocket,omitempty" yaml:"localSocket,omitempty" toml:"localSocket,omitempty"` // used instead of LocalPort
+	RemoteHost  string `json:"remoteHost,omitempty" yaml:"remoteHost,omitempty" toml:"remoteHost,omitempty"`    // local tunnels only, defaults to "localhost"
+	RemotePort  int32  `json:"remotePort,omitempty" yaml:"remotePort,omitempty" toml:"remotePort,omitempty"`    // required unless dynamic or using a remote socket
+	// Used instead of RemoteHost and RemotePort, e.g. "/var/run/docker.sock"
+	RemoteSocket string `json:"remoteSocket,omitempty" yaml:"remoteSocket,omitempty" toml:"remoteSocket,omitempty"`
+	DefaultUrl   string `json:"defaultUrl,omitempty" yaml:"defaultUrl,omitempty" toml:"defaultUrl,omitempty"`
+}
+
+// The host the forwarded connections are sent to from the ssh server, with the default filled in
+func (f Forward) TargetHost() string {
+	if f.RemoteHost == "" {
+		return "localhost"
+	}
+	return f.RemoteHost
+}
+
+// The local end of the forward for display: a port or a socket path
+func (f Forward) LocalEnd() string {
+	if f.LocalSocket != "" {
+		return f.LocalSocket
+	}
+	return fmt.Sprintf("%d", f.LocalPort)
+}
+
+// The remote end of the forward for display: a port or a socket path
+func (f Forward) RemoteEnd() string {
+	if f.RemoteSocket != "" {
+		return f.RemoteSocket
+	}
+	return fmt.Sprintf("%d", f.RemotePort)
+}
+
+// Whether either end of the forward is a unix socket
+func (f Forward) usesSockets() bool {
+	return f.LocalSocket != "" || f.RemoteSocket != ""
+}
+
+// The listening and target ends of the forward in ssh's syntax, for a tunnel of the given type
+// For remote tunnels the listening port is on the remote host. Dynamic forwards have no target.
+func (f Forward) ends(kind string) (listen, target string) {
+	bind := ""
+	if f.BindAddress != "" {
+		bind = sshAddress(f.BindAddress) + ":"
+	}
+
+	// Sockets replace both the address and the port
+	local := fmt.Sprintf("%s%d", bind, f.LocalPort)
+	if f.LocalSocket != "" {
+		local = f.LocalSocket
+	}
+	remote := fmt.Sprintf("%s:%d", sshAddress(f.TargetHost()), f.RemotePort)
+	if f.RemoteSocket != "" {
+		remote = f.RemoteSocket
+	}
+
+	switch kind {
+	case TunnelTypeRemote:
+		localHost := "localhost"
+		if f.BindAddress != "" {
+			localHost = sshAddress(f.BindAddress)
+		}
+		local = fmt.Sprintf("%s:%d", localHost, f.LocalPort)
+		if f.LocalSocket != "" {
+			local = f.LocalSocket
+		}
+		remote = fmt.Sprintf("%d", f.RemotePort)
+		if f.RemoteSocket != "" {
+			remote = f.RemoteSocket
+		}
+		return remote, local
+	case TunnelTypeDynamic:
+		return local, ""
+	}
+	return local, remote
+}
+
+// The ssh flag for this forward, for a tunnel of the given type
+func (f Forward) spec(kind string) string {
+	return strings.Join(f.args(kind), " ")
+}
+
+// The ssh arguments for this forward, for a tunnel of the given type
+func (f Forward) args(kind string) []string {
+	listen, target := f.ends(kind)
+	switch kind {
+	case TunnelTypeRemote:
+		return []string{"-R", fmt.Sprintf("%s:%s", listen, target)}
+	case TunnelTypeDynamic:
+		return []string{"-D", listen}
+	}
+	return []string{"-L", fmt.Sprintf("%s:%s", listen, target)}
+}
+
+// The ssh config option for this forward, for a tunnel of the given type
+func (f Forward) sshConfigOption(kind string) string {
+	listen, target := f.ends(kind)
+	listen, target = sshConfigQuote(listen), sshConfigQuote(target)
+	switch kind {
+	case TunnelTypeRemote:
+		return fmt.Sprintf("RemoteForward %s %s", listen, target)
+	case TunnelTypeDynamic:
+		return fmt.Sprintf("DynamicForward %s", listen)
+	}
+	return fmt.Sprintf("LocalForward %s %s", listen, target)
+}
+
+// Whether the forward listens on all interfaces
+func (f Forward) bindsAll() bool {
+	switch f.BindAddress {
+	case "*", "0.0.0.0", "::":
+		return true
+	}
+	return false
+}
+
+// The address the forward listens on locally, with ssh's default filled in
+func (f Forward) listenAddress() string {
+	if f.BindAddress == "" {
+		return "localhost"
+	}
+	return f.BindAddress
+}
+
+// The local end of the forward with the address it listens on, for messages
+func (f Forward) listenEnd() string {
+	if f.LocalSocket != "" {
+		return f.LocalSocket
+	}
+	return net.JoinHostPort(f.listenAddress(), fmt.Sprintf("%d", f.LocalPort))
+}
+
+// Whether two forwards would listen on the same local port or socket
+// Ports clash if the addresses are the same, or if either forward listens on all interfaces.
+func (f Forward) localClash(other Forward) bool {
+	if f.LocalSocket != "" || other.LocalSocket != "" {
+		return f.LocalSocket == other.LocalSocket
+	}
+	if f.LocalPort == 0 || f.LocalPort != other.LocalPort {
+		return false
+	}
+	if f.bindsAll() || other.bindsAll() {
+		return true
+	}
+	a, b := f.listenAddress(), other.listenAddress()
+	if a == b {
+		return true
+	}
+	// localhost listens on both loopback addresses
+	loopback := map[string]bool{"127.0.0.1": true, "::1": true}
+	return (a == "localhost" && loopback[b]) || (b == "localhost" && loopback[a])
+}
+
+// The host to connect to to reach the local end of the forward
+func (f Forward) dialHost() string {
+	switch {
+	case f.BindAddress == "::":
+		return "::1"
+	case f.bindsAll():
+		return "127.0.0.1"
+	}
+	return f.BindAddress
+}
+
+// The link to the default page behind a local forward
+// Forwards listening on all interfaces are linked through uiHost, the host the web UI was reached on
+func (f Forward) URLFor(uiHost string) string {
+	host := f.dialHost()
+	if f.bindsAll() {
+		host = uiHost
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("http://%s%s", net.JoinHostPort(host, fmt.Sprintf("%d", f.LocalPort)), f.DefaultUrl)
+}
+
+// The prefix for field names of the nth forward of a tunnel
+// The first forward is the tunnel's own fields, and the rest are listed in `forwards`.
+func forwardPrefix(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprintf("forwards[%d].", n-1)
+}
+
+// The field the local end of the forward is set by
+func (f Forward) localEndField() string {
+	if f.LocalSocket != "" {
+		return "localSocket"
+	}
+	return "localPort"
+}
+
+// The field the remote end of the forward is set by
+func (f Forward) remoteEndField() string {
+	if f.RemoteSocket != "" {
+		return "remoteSocket"
+	}
+	return "remotePort"
+}
+
+// Problems with the forward, with field names starting with prefix
+func (f Forward) validationErrors(kind, prefix string) ValidationErrors {
+	var errs ValidationErrors
+	add := func(field, format string, a ...interface{}) {
+		errs = append(errs, ValidationError{Index: -1, Field: prefix + field, Message: fmt.Sprintf(format, a...)})
+	}
+
+	switch {
+	case f.LocalSocket != "" && f.LocalPort != 0:
+		add("localSocket", "Only one of local port and local socket can be set")
+	case f.LocalSocket != "":
+		if !filepath.IsAbs(f.LocalSocket) {
+			add("localSocket", "Local socket '%s' must be an absolute path", f.LocalSocket)
+		}
+	case f.LocalPort == 0:
+		add("localPort", "Local port or local socket is required")
+	case f.LocalPort < 0 || f.LocalPort > maxPort:
+		add("localPort", "Local port %d is out of range, it must be between 1 and %d", f.LocalPort, maxPort)
+	}
+
+	if kind == TunnelTypeDynamic {
+		if f.LocalSocket != "" {
+			add("localSocket", "Sockets are not supported for dynamic tunnels")
+		}
+		if f.RemoteSocket != "" {
+			add("remoteSocket", "Sockets are not supported for dynamic tunnels")
+		}
+	} else {
+		switch {
+		case f.RemoteSocket != "" && (f.RemotePort != 0 || f.RemoteHost != ""):
+			add("remoteSocket", "Remote socket can't be combined with a remote host or port")
+		case f.RemoteSocket != "":
+			if !strings.HasPrefix(f.RemoteSocket, "/") {
+				add("remoteSocket", "Remote socket '%s' must be an absolute path", f.RemoteSocket)
+			}
+		case f.RemotePort == 0:
+			add("remotePort", "Remote port or remote socket is required for %s tunnels", kind)
+		case f.RemotePort < 0 || f.RemotePort > maxPort:
+			add("remotePort", "Remote port %d is out of range, it must be between 1 and %d", f.RemotePort, maxPort)
+		}
+	}
+
+	if f.RemoteHost != "" && kind != TunnelTypeLocal {
+		add("remoteHost", "Remote host is only supported for local tunnels")
+	}
+	if f.BindAddress != "" && f.BindAddress != "*" && f.BindAddress != "localhost" && net.ParseIP(f.BindAddress) == nil {
+		add("bindAddress", "Bind address '%s' must be an IP address, 'localhost' or '*'", f.BindAddress)
+	}
+	if f.DefaultUrl != "" {
+		// Appended to the forward's address to make a link, see `URLFor`
+		if u, err := url.Parse(f.DefaultUrl); err != nil || !strings.HasPrefix(f.DefaultUrl, "/") || u.Host != "" {
+			add("defaultUrl", "Default URL '%s' must be a path starting with '/'", f.DefaultUrl)
+		}
+	}
+	return errs
+}
+
+// Check if something is accepting connections on the local end of the forward
+func (f Forward) InUse() bool {
+	// Check if this port is already in use
+	// https://stackoverflow.com/questions/40296483/continuously-check-if-tcp-port-is-in-use
+	network, address := "tcp", net.JoinHostPort(f.dialHost(), fmt.Sprintf("%d", f.LocalPort))
+	if f.LocalSocket != "" {
+		network, address = "unix", f.LocalSocket
+	}
+	// Loopback connections are refused immediately when nothing is listening, so this only waits on a busy machine
+	conn, _ := net.DialTimeout(network, address, time.Duration(50*time.Millisecond))
+	if conn != nil {
+		conn.Close()
+		return true
+	}
+	return false
+}
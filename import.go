@@ -0,0 +1,379 @@
+package tnnlr
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"labix.org/v2/mgo/bson"
+)
+
+/*
+Importing tunnels from the forwards in an ssh config, see sshconfig.go.
+
+Each host alias with forwards becomes a tunnel per forwarding type, e.g. "db" with two
+`LocalForward`s becomes one local tunnel carrying both. Candidates are previewed first, with the host
+name and user ssh would resolve the alias to, and then the chosen ones are added to a profile.
+*/
+
+// A tunnel that can be imported from an ssh config
+type SshConfigImport struct {
+	Tunnel   Tunnel   `json:"tunnel"`
+	HostName string   `json:"hostName"`           // what ssh resolves the alias to
+	User     string   `json:"user,omitempty"`     // "" if ssh's default is used
+	Port     string   `json:"port,omitempty"`     // "" if ssh's default is used
+	Source   string   `json:"source"`             // where the alias is defined, as file:line
+	Warnings []string `json:"warnings,omitempty"` // parts of the ssh config left out of the tunnel
+	Problems []string `json:"problems,omitempty"` // reasons the tunnel can't be imported
+	Exists   bool     `json:"exists"`             // a tunnel with the same name is already in the profile
+}
+
+// Whether the tunnel can be added as it is
+func (i SshConfigImport) Importable() bool {
+	return !i.Exists && len(i.Problems) == 0
+}
+
+// The forwards of the tunnel, if any could be read from the ssh config
+func (i SshConfigImport) Forwards() []Forward {
+	if i.Tunnel.LocalPort == 0 && i.Tunnel.LocalSocket == "" {
+		return nil
+	}
+	return i.Tunnel.AllForwards()
+}
+
+// The tunnels for the forwards of a single host alias
+func sshHostImports(host sshHostConfig) []SshConfigImport {
+	byKind := make(map[string]*SshConfigImport)
+	var kinds []string
+	var warnings []string
+	for _, option := range host.forwards {
+		kind, f, fWarnings, err := sshConfigForward(option)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: skipping %s: %s", option.source, strings.Join(append([]string{option.name}, option.args...), " "), err.Error()))
+			continue
+		}
+		imp, ok := byKind[kind]
+		if !ok {
+			imp = &SshConfigImport{
+				Tunnel: Tunnel{
+					Name: host.Alias,
+					Type: kind,
+					Host: host.Alias,
+				},
+				HostName: host.HostName,
+				User:     host.User,
+				Port:     host.Port,
+				Source:   host.Source,
+			}
+			if kind != TunnelTypeDynamic {
+				imp.Tunnel.DefaultUrl = "/"
+			}
+			byKind[kind] = imp
+			kinds = append(kinds, kind)
+		}
+		imp.Warnings = append(imp.Warnings, fWarnings...)
+
+		// The first forward is described by the tunnel's own fields
+		tnnl := &imp.Tunnel
+		if tnnl.LocalPort == 0 && tnnl.LocalSocket == "" {
+			tnnl.BindAddress, tnnl.LocalPort, tnnl.LocalSocket = f.BindAddress, f.LocalPort, f.LocalSocket
+			tnnl.RemoteHost, tnnl.RemotePort, tnnl.RemoteSocket = f.RemoteHost, f.RemotePort, f.RemoteSocket
+			if tnnl.LocalSocket != "" {
+				tnnl.DefaultUrl = ""
+			}
+			continue
+		}
+		if kind != TunnelTypeDynamic && f.LocalSocket == "" {
+			f.DefaultUrl = "/"
+		}
+		tnnl.Forwards = append(tnnl.Forwards, f)
+	}
+
+	var imports []SshConfigImport
+	for _, kind := range kinds {
+		imp := byKind[kind]
+		// Tunnels of the same host need different names
+		if len(kinds) > 1 {
+			imp.Tunnel.Name = fmt.Sprintf("%s-%s", host.Alias, kind)
+		}
+		imp.Warnings = append(imp.Warnings, warnings...)
+		for _, err := range imp.Tunnel.validationErrors() {
+			imp.Problems = append(imp.Problems, err.Error())
+		}
+		imports = append(imports, *imp)
+	}
+	if len(kinds) == 0 && len(warnings) > 0 {
+		// Nothing usable, but say why rather than leaving the host out silently
+		imports = append(imports, SshConfigImport{
+			Tunnel:   Tunnel{Name: host.Alias, Host: host.Alias},
+			HostName: host.HostName,
+			User:     host.User,
+			Port:     host.Port,
+			Source:   host.Source,
+			Problems: warnings,
+		})
+	}
+	return imports
+}
+
+// The tunnels that could be imported from an ssh config into a profile
+// Tunnels are marked as existing if the profile's file or its running tunnels already have the name.
+func (t *Tnnlr) PlanSshConfigImport(path string, p *Profile) ([]SshConfigImport, error) {
+	sections, err := parseSshConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := p.decode()
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	var listening []*Tunnel
+	addTunnel := func(tnnl *Tunnel) {
+		existing[tnnl.Name] = true
+		// Remote tunnels listen on the remote host, see `ValidateTunnels`
+		if !tnnl.IsRemote() {
+			listening = append(listening, tnnl)
+		}
+	}
+	// The tunnel already listening where the forward would, if any
+	usedBy := func(f Forward) (Forward, string, bool) {
+		for _, tnnl := range listening {
+			for _, other := range tnnl.AllForwards() {
+				if f.localClash(other) {
+					return other, tnnl.Name, true
+				}
+			}
+		}
+		return Forward{}, "", false
+	}
+	for _, tnnl := range t.ProfileTunnels(p.Name) {
+		addTunnel(tnnl)
+	}
+	for i := range doc.Tunnels {
+		addTunnel(&doc.Tunnels[i])
+	}
+
+	// Tunnels clashing with ones already there, or picked earlier, are left for the user to sort out
+	var imports []SshConfigImport
+	for _, host := range sshConfigHosts(sections) {
+		for _, imp := range sshHostImports(host) {
+			imp.Exists = existing[imp.Tunnel.Name]
+			imp.Tunnel.profile = p.Name
+			if !imp.Tunnel.IsRemote() {
+				for _, f := range imp.Forwards() {
+					if other, name, ok := usedBy(f); ok {
+						imp.Problems = append(imp.Problems, fmt.Sprintf("%s is already used by tunnel '%s'", other.listenEnd(), name))
+					}
+				}
+			}
+			if imp.Importable() {
+				addTunnel(&imp.Tunnel)
+			}
+			imports = append(imports, imp)
+		}
+	}
+	return imports, nil
+}
+
+// The ssh config to import from, from the request or the server's default
+func (t *Tnnlr) requestSshConfig(c *gin.Context) string {
+	return c.DefaultPostForm("sshConfig", c.DefaultQuery("sshConfig", t.SshConfig))
+}
+
+// Show the tunnels that can be imported from the ssh config
+// Responds with json when called with `?format=json`
+func (t *Tnnlr) ImportSshConfigPreview(c *gin.Context) {
+	sshConfig := t.requestSshConfig(c)
+	p, err := t.requestProfile(c)
+	if err != nil {
+		if c.Query("format") == "json" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		t.AddMessage(err.Error())
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	imports, err := t.PlanSshConfigImport(sshConfig, p)
+	if err != nil {
+		message := fmt.Sprintf("Failed to read ssh config: %s", err.Error())
+		log.WithFields(log.Fields{
+			"err":       err.Error(),
+			"sshConfig": sshConfig,
+		}).Error("Failed to read ssh config")
+		if c.Query("format") == "json" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": message})
+			return
+		}
+		t.AddMessage(message)
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	if c.Query("format") == "json" {
+		c.JSON(http.StatusOK, gin.H{"sshConfig": sshConfig, "profile": p.Name, "tunnels": imports})
+		return
+	}
+
+	data := struct {
+		Profile   string
+		File      string
+		SshConfig string
+		Imports   []SshConfigImport
+	}{
+		p.Name,
+		p.File,
+		sshConfig,
+		imports,
+	}
+	if err := t.Template.ExecuteTemplate(c.Writer, "ImportSshConfig", data); err != nil {
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+		}).Error("Error executing template")
+	}
+}
+
+// Add the tunnels picked from the preview
+// The tunnels are looked up again by name, so only tunnels still in the ssh config are added.
+func (t *Tnnlr) ImportSshConfig(c *gin.Context) {
+	p, err := t.requestProfile(c)
+	if err != nil {
+		t.AddMessage(err.Error())
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	sshConfig := t.requestSshConfig(c)
+	imports, err := t.PlanSshConfigImport(sshConfig, p)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err.Error(),
+			"sshConfig": sshConfig,
+		}).Error("Failed to read ssh config")
+		t.AddMessage(fmt.Sprintf("Failed to read ssh config: %s", err.Error()))
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range c.PostFormArray("tunnel") {
+		selected[name] = true
+	}
+	imported := 0
+	for _, imp := range imports {
+		if !selected[imp.Tunnel.Name] {
+			continue
+		}
+		if !imp.Importable() {
+			t.AddMessage(fmt.Sprintf("Skipping tunnel '%s', it can't be imported", imp.Tunnel.Name))
+			continue
+		}
+		if err := t.AddTunnel(imp.Tunnel); err != nil {
+			message := fmt.Sprintf("Unable to add tunnel: %s", imp.Tunnel.Name)
+			log.WithFields(log.Fields{
+				"err": err.Error(),
+			}).Error(message)
+			t.AddMessage(message)
+			continue
+		}
+		imported++
+	}
+
+	t.AddMessage(fmt.Sprintf("Imported %d tunnels from ssh config %s", imported, sshConfig))
+	c.Redirect(http.StatusFound, "/")
+}
+
+// Print the tunnels that can be imported from an ssh config into a profile, and with apply add them
+// to the profile's tunnels file
+// This runs without a server, so nothing is started.
+func (t *Tnnlr) ImportSshConfigToFile(out io.Writer, sshConfig, profile string, apply bool) error {
+	p, err := t.commandProfile(profile)
+	if err != nil {
+		return err
+	}
+	imports, err := t.PlanSshConfigImport(sshConfig, p)
+	if err != nil {
+		return err
+	}
+
+	var added []Tunnel
+	for _, imp := range imports {
+		status := "new"
+		switch {
+		case imp.Exists:
+			status = "exists"
+		case len(imp.Problems) > 0:
+			status = "invalid"
+		default:
+			added = append(added, imp.Tunnel)
+		}
+		login := imp.HostName
+		if imp.User != "" {
+			login = imp.User + "@" + login
+		}
+		if imp.Port != "" {
+			login += ":" + imp.Port
+		}
+		fmt.Fprintf(out, "%-8s %s (%s) via %s -> %s\n", status, imp.Tunnel.Name, imp.Tunnel.Kind(), imp.Tunnel.Host, login)
+		for _, f := range imp.Forwards() {
+			fmt.Fprintf(out, "           %s\n", f.spec(imp.Tunnel.Kind()))
+		}
+		for _, warning := range imp.Warnings {
+			fmt.Fprintf(out, "           warning: %s\n", warning)
+		}
+		for _, problem := range imp.Problems {
+			fmt.Fprintf(out, "           error: %s\n", problem)
+		}
+	}
+
+	if !apply {
+		fmt.Fprintf(out, "%d tunnels can be added to %s, run again with --apply to add them\n", len(added), p.File)
+		return nil
+	}
+	if len(added) == 0 {
+		fmt.Fprintf(out, "Nothing to add to %s\n", p.File)
+		return nil
+	}
+
+	// Keep the file's tunnels as they are written, placeholders and all
+	doc, err := p.decode()
+	if err != nil {
+		return err
+	}
+	var tunnels []*Tunnel
+	for i := range doc.Tunnels {
+		tunnels = append(tunnels, &doc.Tunnels[i])
+	}
+	for i := range added {
+		added[i].Id = bson.NewObjectId().Hex()
+		tunnels = append(tunnels, &added[i])
+	}
+	if err := p.Save(tunnels); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Added %d tunnels to %s\n", len(added), p.File)
+	return nil
+}
+
+// The profile's file as written, without expanding variables
+// A missing file has no tunnels.
+func (p *Profile) decode() (tunnelsFile, error) {
+	if p.isExecutable() {
+		return tunnelsFile{}, fmt.Errorf("%s is an executable, so it can't be read as a tunnels file", p.File)
+	}
+	raw, err := ioutil.ReadFile(p.File)
+	if os.IsNotExist(err) {
+		return tunnelsFile{}, nil
+	}
+	if err != nil {
+		return tunnelsFile{}, err
+	}
+	return decodeTunnelsFile(raw, p.fileFormat())
+}
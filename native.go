@@ -0,0 +1,505 @@
+package tnnlr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+/*
+In-process ssh backend built on golang.org/x/crypto/ssh.
+
+This is useful where there is no ssh client installed, and because the connection is owned by tnnlr
+we know exactly what state it is in instead of guessing from open ports.
+
+It doesn't read ~/.ssh/config, so hosts and jump hosts have to be given as [user@]host[:port].
+Authentication uses keys from ssh-agent and private key files (the tunnel's identity file, or the
+usual default keys), and host keys are checked against ~/.ssh/known_hosts.
+*/
+
+// Connection states for native tunnels
+const (
+	nativeConnecting = "connecting"
+	nativeConnected  = "connected"
+	nativeClosed     = "closed"
+)
+
+var nativeKeepAliveInterval = 30 * time.Second
+var nativeDialTimeout = 15 * time.Second
+
+// Key files tried when a tunnel doesn't list its own
+var defaultIdentityFiles = []string{
+	"~/.ssh/id_ed25519",
+	"~/.ssh/id_ecdsa",
+	"~/.ssh/id_rsa",
+}
+
+// Runs tunnels in-process
+type nativeBackend struct{}
+
+func (b *nativeBackend) Start(t *Tunnel) error {
+	n, err := startNative(t)
+	if err != nil {
+		return err
+	}
+	// The tunnel lives as long as this process
+	t.native = n
+	t.Pid = os.Getpid()
+	if err := t.writePidFile(); err != nil {
+		n.Stop()
+		t.native = nil
+		t.Pid = 0
+		return err
+	}
+	return nil
+}
+
+func (b *nativeBackend) Stop(t *Tunnel) error {
+	if t.native != nil {
+		t.native.Stop()
+		t.native = nil
+	}
+	return nil
+}
+
+func (b *nativeBackend) Status(t *Tunnel) string {
+	if t.native == nil {
+		return StatusDead
+	}
+	switch t.native.State() {
+	case nativeConnecting:
+		return StatusStarting
+	case nativeConnected:
+		return StatusUp
+	}
+	return StatusDead
+}
+
+// The equivalent ssh command
+func (b *nativeBackend) Command(t *Tunnel) string {
+	return t.sshCommand()
+}
+
+func (b *nativeBackend) LogPath(t *Tunnel) (string, error) {
+	return t.LogPath()
+}
+
+type nativeTunnel struct {
+	sync.Mutex
+	state     string
+	err       error         // why the connection closed
+	clients   []*ssh.Client // jump hosts first, target host last
+	listeners []net.Listener
+	agentConn net.Conn
+	logOut    *os.File
+	logger    *log.Logger
+	stopped   bool // set once Stop is called
+}
+
+// Start connecting in the background
+// Connection progress and errors are written to the tunnel's logfile
+func startNative(t *Tunnel) (*nativeTunnel, error) {
+	logPath, err := t.LogPath()
+	if err != nil {
+		return nil, err
+	}
+	logOut, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := log.New()
+	logger.Out = logOut
+	logger.Formatter = &log.TextFormatter{DisableColors: true}
+
+	n := &nativeTunnel{
+		state:  nativeConnecting,
+		logOut: logOut,
+		logger: logger,
+	}
+	go n.connect(*t)
+	return n, nil
+}
+
+func (n *nativeTunnel) connect(t Tunnel) {
+	n.logger.WithFields(log.Fields{
+		"host":      t.Host,
+		"jumpHosts": t.JumpHosts,
+	}).Info("Connecting")
+
+	hostKeyCallback, err := nativeHostKeyCallback()
+	if err != nil {
+		n.fail(err)
+		return
+	}
+	auth := n.authMethods(t.IdentityFile)
+
+	// Connect through each jump host in turn
+	hops := append(append([]string{}, t.JumpHosts...), t.Host)
+	for _, hop := range hops {
+		username, addr := parseHop(hop, t.Username)
+		config := &ssh.ClientConfig{
+			User:              username,
+			Auth:              auth,
+			HostKeyCallback:   hostKeyCallback,
+			HostKeyAlgorithms: knownHostKeyAlgorithms(hostKeyCallback, addr),
+			Timeout:           nativeDialTimeout,
+		}
+
+		var client *ssh.Client
+		if len(n.clients) == 0 {
+			client, err = ssh.Dial("tcp", addr, config)
+		} else {
+			client, err = n.dialThrough(n.clients[len(n.clients)-1], addr, config)
+		}
+		if err != nil {
+			n.fail(fmt.Errorf("Failed to connect to %s: %s", addr, err.Error()))
+			return
+		}
+		if !n.addClient(client) {
+			return
+		}
+		n.logger.WithField("addr", addr).Info("Connected")
+	}
+	client := n.clients[len(n.clients)-1]
+
+	for _, f := range t.AllForwards() {
+		l, err := n.listen(client, t.Kind(), f)
+		if err != nil {
+			n.fail(err)
+			return
+		}
+		if !n.addListener(l) {
+			return
+		}
+		go n.serve(client, t.Kind(), f, l)
+	}
+
+	n.Lock()
+	if n.state == nativeConnecting {
+		n.state = nativeConnected
+	}
+	n.Unlock()
+	n.logger.Info("All forwards are listening")
+
+	go n.keepAlive(client)
+	err = client.Wait()
+	n.fail(fmt.Errorf("Connection closed: %v", err))
+}
+
+func (n *nativeTunnel) dialThrough(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// Listen on the listening end of a forward
+// This is local for local and dynamic tunnels, and on the ssh server for remote tunnels
+func (n *nativeTunnel) listen(client *ssh.Client, kind string, f Forward) (net.Listener, error) {
+	if kind == TunnelTypeRemote {
+		if f.RemoteSocket != "" {
+			return client.ListenUnix(f.RemoteSocket)
+		}
+		return client.Listen("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprintf("%d", f.RemotePort)))
+	}
+
+	if f.LocalSocket != "" {
+		// Replace socket files left behind by an earlier run, like ssh's StreamLocalBindUnlink
+		os.Remove(f.LocalSocket)
+		return net.Listen("unix", f.LocalSocket)
+	}
+	bind := f.BindAddress
+	switch bind {
+	case "":
+		bind = "127.0.0.1"
+	case "*":
+		bind = ""
+	}
+	return net.Listen("tcp", net.JoinHostPort(bind, fmt.Sprintf("%d", f.LocalPort)))
+}
+
+// Accept connections on a forward until the listener is closed
+func (n *nativeTunnel) serve(client *ssh.Client, kind string, f Forward, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			var target net.Conn
+			var err error
+			switch kind {
+			case TunnelTypeDynamic:
+				target, err = socksConnect(conn, client.Dial)
+			case TunnelTypeRemote:
+				host := f.dialHost()
+				if host == "" {
+					host = "localhost"
+				}
+				network, addr := "tcp", net.JoinHostPort(host, fmt.Sprintf("%d", f.LocalPort))
+				if f.LocalSocket != "" {
+					network, addr = "unix", f.LocalSocket
+				}
+				target, err = net.Dial(network, addr)
+			default:
+				network, addr := "tcp", net.JoinHostPort(f.TargetHost(), fmt.Sprintf("%d", f.RemotePort))
+				if f.RemoteSocket != "" {
+					network, addr = "unix", f.RemoteSocket
+				}
+				target, err = client.Dial(network, addr)
+			}
+			if err != nil {
+				n.logger.WithField("err", err).Warn("Failed to open forwarded connection")
+				conn.Close()
+				return
+			}
+			pipeConns(conn, target)
+		}()
+	}
+}
+
+// Send keepalives so dead connections are noticed, like ssh's ServerAliveInterval
+func (n *nativeTunnel) keepAlive(client *ssh.Client) {
+	for {
+		time.Sleep(nativeKeepAliveInterval)
+		if n.State() != nativeConnected {
+			return
+		}
+		if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			n.fail(fmt.Errorf("Keepalive failed: %s", err.Error()))
+			return
+		}
+	}
+}
+
+// Keys from ssh-agent are tried first, then key files
+// These are offered as a single method since each method is only tried once per connection
+func (n *nativeTunnel) authMethods(identityFile string) []ssh.AuthMethod {
+	var signers []ssh.Signer
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			n.logger.WithField("err", err).Warn("Unable to connect to ssh-agent")
+		} else {
+			n.Lock()
+			n.agentConn = conn
+			n.Unlock()
+			agentSigners, err := agent.NewClient(conn).Signers()
+			if err != nil {
+				n.logger.WithField("err", err).Warn("Unable to list keys in ssh-agent")
+			}
+			signers = append(signers, agentSigners...)
+		}
+	}
+
+	identityFiles := defaultIdentityFiles
+	if identityFile != "" {
+		identityFiles = []string{identityFile}
+	}
+	for _, keyFile := range identityFiles {
+		path, err := homedir.Expand(keyFile)
+		if err != nil {
+			continue
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			if identityFile != "" {
+				n.logger.WithField("err", err).Warn("Unable to read identity file")
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(raw)
+		if err != nil {
+			// Most likely encrypted, which needs a passphrase we don't have
+			n.logger.WithFields(log.Fields{
+				"err":  err,
+				"file": path,
+			}).Warn("Unable to use private key, load it into ssh-agent instead")
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}
+}
+
+func nativeHostKeyCallback() (ssh.HostKeyCallback, error) {
+	path, err := homedir.Expand("~/.ssh/known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	cb, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load known hosts from %s: %s", path, err.Error())
+	}
+	return cb, nil
+}
+
+// The types of the host's keys in known_hosts, or nil to use the default order if there are none
+// Otherwise servers send their preferred key, which fails the check if known_hosts has another type.
+func knownHostKeyAlgorithms(cb ssh.HostKeyCallback, addr string) []string {
+	keyErr, ok := cb(addr, &net.TCPAddr{}, probeKey{}).(*knownhosts.KeyError)
+	if !ok {
+		return nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		algorithms = append(algorithms, known.Key.Type())
+	}
+	sort.Strings(algorithms)
+	return algorithms
+}
+
+// A key no host has, for looking up a host's known keys
+type probeKey struct{}
+
+func (probeKey) Type() string    { return "tnnlr-probe" }
+func (probeKey) Marshal() []byte { return []byte("tnnlr-probe") }
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error {
+	return errors.New("Probe keys can't verify signatures")
+}
+
+// Split a [user@]host[:port] string into the user to log in as and the address to dial
+func parseHop(hop string, defaultUser string) (string, string) {
+	username := defaultUser
+	if i := strings.LastIndex(hop, "@"); i != -1 {
+		username, hop = hop[:i], hop[i+1:]
+	}
+	if username == "" {
+		if u, err := user.Current(); err == nil {
+			username = u.Username
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(hop); err == nil {
+		return username, hop
+	}
+	return username, net.JoinHostPort(strings.Trim(hop, "[]"), "22")
+}
+
+func (n *nativeTunnel) addClient(c *ssh.Client) bool {
+	n.Lock()
+	defer n.Unlock()
+	if n.state == nativeClosed {
+		c.Close()
+		return false
+	}
+	n.clients = append(n.clients, c)
+	return true
+}
+
+func (n *nativeTunnel) addListener(l net.Listener) bool {
+	n.Lock()
+	defer n.Unlock()
+	if n.state == nativeClosed {
+		l.Close()
+		return false
+	}
+	n.listeners = append(n.listeners, l)
+	return true
+}
+
+// Record why the tunnel went down and clean up
+func (n *nativeTunnel) fail(err error) {
+	n.Lock()
+	defer n.Unlock()
+	if n.state == nativeClosed {
+		return
+	}
+	n.logger.WithField("err", err).Error("Tunnel is down")
+	n.err = err
+	n.closeAll()
+}
+
+// Stop the tunnel
+func (n *nativeTunnel) Stop() {
+	n.Lock()
+	defer n.Unlock()
+	if n.stopped {
+		return
+	}
+	n.stopped = true
+	if n.state != nativeClosed {
+		n.logger.Info("Stopping")
+		n.closeAll()
+	}
+	n.logOut.Close()
+}
+
+// Must be called with the lock held
+func (n *nativeTunnel) closeAll() {
+	n.state = nativeClosed
+	for _, l := range n.listeners {
+		l.Close()
+	}
+	// Close the connection to the target host before the jump hosts it runs through
+	for i := len(n.clients) - 1; i >= 0; i-- {
+		n.clients[i].Close()
+	}
+	if n.agentConn != nil {
+		n.agentConn.Close()
+	}
+}
+
+func (n *nativeTunnel) State() string {
+	n.Lock()
+	defer n.Unlock()
+	return n.state
+}
+
+// The state with the reason the tunnel closed, if any
+func (n *nativeTunnel) Status() string {
+	n.Lock()
+	defer n.Unlock()
+	if n.err != nil {
+		return fmt.Sprintf("%s: %s", n.state, n.err.Error())
+	}
+	return n.state
+}
+
+// Why the connection closed, nil if it is still open or was stopped
+func (n *nativeTunnel) Err() error {
+	n.Lock()
+	defer n.Unlock()
+	return n.err
+}
+
+func (n *nativeTunnel) IsAlive() bool {
+	return n.State() == nativeConnected
+}
+
+// Copy data in both directions until either side closes
+func pipeConns(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	a.Close()
+	b.Close()
+}
@@ -16,6 +16,7 @@ var baseDir = "~/.tnnlr"
 
 var relProc = "proc"
 var relLog = "log"
+var relInventory = "inventory"
 
 func getRelativePath(subdir string) (string, error) {
 	basePath, err := homedir.Expand(baseDir)
@@ -0,0 +1,103 @@
+package tnnlr
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+/*
+Proxy auto-config (PAC) generation for dynamic tunnels.
+
+Each dynamic tunnel lists the host patterns that should be sent through its SOCKS proxy.
+Anything that doesn't match a pattern is connected to directly.
+
+See: https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_PAC_file
+*/
+
+// Check that a proxy pattern can be rendered into a PAC file
+// Patterns containing a "/" are treated as IPv4 CIDRs, everything else as a shell expression
+func validateProxyPattern(pattern string) error {
+	if !strings.Contains(pattern, "/") {
+		return nil
+	}
+	ip, _, err := net.ParseCIDR(pattern)
+	if err != nil {
+		return err
+	}
+	if ip.To4() == nil {
+		return fmt.Errorf("Only IPv4 CIDRs are supported in proxy patterns, got '%s'", pattern)
+	}
+	return nil
+}
+
+// The PAC condition matching a single pattern
+func pacCondition(pattern string) string {
+	if _, ipNet, err := net.ParseCIDR(pattern); err == nil && ipNet.IP.To4() != nil {
+		return fmt.Sprintf("isInNet(host, %q, %q)", ipNet.IP.String(), net.IP(ipNet.Mask).String())
+	}
+	return fmt.Sprintf("shExpMatch(host, %q)", pattern)
+}
+
+// A tunnel name for a PAC comment, with line breaks and other unprintable characters replaced
+func pacComment(name string) string {
+	return strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return ' '
+		}
+		return r
+	}, name)
+}
+
+// Build a PAC file routing the proxy patterns of each dynamic tunnel through that tunnel
+// Tunnels that aren't up are left out, so browsers connect directly instead of failing.  Tunnels
+// with several forwards list them all, and browsers try each in turn.
+func generatePAC(tunnels []*Tunnel) string {
+	// Sort by name so the output is stable
+	var dynamic []*Tunnel
+	for _, tnnl := range tunnels {
+		if tnnl.IsDynamic() && tnnl.Status() == StatusUp {
+			dynamic = append(dynamic, tnnl)
+		}
+	}
+	sort.Slice(dynamic, func(i, j int) bool {
+		return dynamic[i].Name < dynamic[j].Name
+	})
+
+	var b bytes.Buffer
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	for _, tnnl := range dynamic {
+		if len(tnnl.ProxyPatterns) == 0 {
+			continue
+		}
+		var conditions []string
+		for _, pattern := range tnnl.ProxyPatterns {
+			if validateProxyPattern(pattern) != nil {
+				continue
+			}
+			conditions = append(conditions, pacCondition(pattern))
+		}
+		if len(conditions) == 0 {
+			continue
+		}
+		var proxies []string
+		for _, f := range tnnl.AllForwards() {
+			host := f.dialHost()
+			if host == "" {
+				host = "127.0.0.1"
+			}
+			proxy := net.JoinHostPort(host, fmt.Sprintf("%d", f.LocalPort))
+			proxies = append(proxies, "SOCKS5 "+proxy, "SOCKS "+proxy)
+		}
+		fmt.Fprintf(&b, "    // %s\n", pacComment(tnnl.Name))
+		fmt.Fprintf(&b, "    if (%s) {\n", strings.Join(conditions, " ||\n        "))
+		fmt.Fprintf(&b, "        return %q;\n", strings.Join(proxies, "; "))
+		b.WriteString("    }\n")
+	}
+	b.WriteString("    return \"DIRECT\";\n")
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,16 @@
+package tnnlr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// The arguments a process was started with, read from /proc
+func processCmdline(pid int) ([]string, error) {
+	c, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(c), "\x00"), "\x00"), nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package tnnlr
+
+// Only supported on linux, elsewhere pids are trusted
+func processCmdline(pid int) ([]string, error) {
+	return nil, errCmdlineUnsupported
+}
@@ -0,0 +1,281 @@
+package tnnlr
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+Tracking of the processes that run tunnels.
+
+Children started by tnnlr are reaped as soon as they exit, so their exit status is known.
+Tunnels loaded from pid files only have a pid, which may have been reused by an unrelated
+process since the file was written, so the command line of the pid is checked where possible.
+*/
+
+// Tunnel statuses
+const (
+	StatusStarting = "starting" // running, but not forwarding yet
+	StatusUp       = "up"
+	StatusDead     = "dead"
+)
+
+// How long processes get to exit after being asked to stop, before they are killed
+const stopGracePeriod = 2 * time.Second
+
+var errCmdlineUnsupported = errors.New("Reading process command lines is not supported on this platform")
+
+var errAdoptedExited = errors.New("exited, status unknown since it was started by an earlier tnnlr")
+
+// A process running a tunnel
+type process struct {
+	cmd  *exec.Cmd // nil for adopted processes
+	pid  int
+	done chan struct{} // closed once the process has exited and been reaped
+	err  error         // the result of Wait, only set once done is closed
+}
+
+// Start a command and reap it in the background when it exits
+func startChild(cmd *exec.Cmd) (*process, error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := &process{
+		cmd:  cmd,
+		pid:  cmd.Process.Pid,
+		done: make(chan struct{}),
+	}
+	go func() {
+		p.err = cmd.Wait()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// Watch a process left running by an earlier tnnlr
+// It isn't our child so it can't be waited on, and is polled with alive instead.
+func adoptProcess(pid int, alive func() bool) *process {
+	p := &process{
+		pid:  pid,
+		done: make(chan struct{}),
+	}
+	go func() {
+		for alive() {
+			time.Sleep(250 * time.Millisecond)
+		}
+		p.err = errAdoptedExited
+		close(p.done)
+	}()
+	return p
+}
+
+func (p *process) Pid() int {
+	return p.pid
+}
+
+func (p *process) Exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// The exit code of the process, or -1 if it is still running, was killed by a signal or is unknown
+func (p *process) ExitCode() int {
+	if !p.Exited() || p.cmd == nil {
+		return -1
+	}
+	status, ok := p.cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok {
+		return -1
+	}
+	return status.ExitStatus()
+}
+
+// Why the process exited, e.g. "exit status 255" or "signal: killed"
+func (p *process) ExitReason() string {
+	if !p.Exited() {
+		return ""
+	}
+	if p.err != nil {
+		return p.err.Error()
+	}
+	return p.cmd.ProcessState.String()
+}
+
+// Ask the process to exit, and kill it if it hasn't within the grace period
+// Then gives it a moment to be reaped, so its ports are free for a restart.
+func (p *process) Stop(grace time.Duration) error {
+	if p.Exited() {
+		return nil
+	}
+	var proc *os.Process
+	if p.cmd != nil {
+		proc = p.cmd.Process
+	} else {
+		var err error
+		if proc, err = os.FindProcess(p.pid); err != nil {
+			return err
+		}
+	}
+
+	// Signals other than kill aren't supported on windows
+	if runtime.GOOS == "windows" || proc.Signal(syscall.SIGTERM) != nil {
+		grace = 0
+	}
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(grace):
+	}
+
+	if err := proc.Kill(); err != nil && !p.Exited() {
+		return err
+	}
+	select {
+	case <-p.done:
+	case <-time.After(1 * time.Second):
+	}
+	return nil
+}
+
+// Whether a process command line is the given arguments, argument by argument
+// The executable is compared by name, since it may have been resolved to a full path, and "" matches
+// any executable that isn't an option.  Scripts show up with their interpreter (and maybe one option)
+// in front, though only the interpreter is skipped for any executable.
+func argvMatches(cmdline, argv []string) bool {
+	for skip := 0; skip <= 2 && skip < len(cmdline); skip++ {
+		rest := cmdline[skip:]
+		if len(rest) != len(argv) || len(argv) == 0 {
+			continue
+		}
+		if argv[0] == "" && (skip > 1 || strings.HasPrefix(rest[0], "-")) {
+			continue
+		}
+		if argv[0] != "" && filepath.Base(rest[0]) != filepath.Base(argv[0]) {
+			continue
+		}
+		matches := true
+		for i := 1; i < len(argv); i++ {
+			if rest[i] != argv[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// Split a shell command into the arguments it is run with
+// Only simple commands can be split, so this returns false for anything with pipes, variables,
+// redirects, globs or variable assignments.
+func shellWords(command string) ([]string, bool) {
+	var words []string
+	var word bytes.Buffer
+	inWord := false
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == '\'':
+			end := strings.IndexByte(command[i+1:], '\'')
+			if end < 0 {
+				return nil, false
+			}
+			word.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			for i++; ; i++ {
+				if i >= len(command) {
+					return nil, false
+				}
+				c = command[i]
+				if c == '"' {
+					break
+				}
+				if c == '$' || c == '`' {
+					return nil, false
+				}
+				if c == '\\' && i+1 < len(command) && strings.IndexByte("$`\"\\", command[i+1]) >= 0 {
+					i++
+					c = command[i]
+				}
+				word.WriteByte(c)
+			}
+			inWord = true
+		case c == '\\':
+			if i+1 >= len(command) {
+				return nil, false
+			}
+			i++
+			word.WriteByte(command[i])
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case strings.IndexByte("|&;<>()$`*?[#~", c) >= 0:
+			return nil, false
+		case c == '=' && len(words) == 0:
+			return nil, false
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, len(words) > 0
+}
+
+// Whether a process command line is the one running this tunnel
+// Native tunnels run inside the tnnlr that wrote their pid file, so their pid is that tnnlr's.
+func (t *Tunnel) ownsCmdline(cmdline []string) bool {
+	if t.owner != 0 && t.Pid == t.owner {
+		return len(cmdline) > 0 && filepath.Base(cmdline[0]) == filepath.Base(os.Args[0])
+	}
+	return t.runsCmdline(cmdline)
+}
+
+// Whether a process command line is the ssh or exec command for this tunnel
+func (t *Tunnel) runsCmdline(cmdline []string) bool {
+	if t.Backend == BackendExec {
+		command, err := t.renderCommand()
+		if err != nil {
+			return false
+		}
+		// The shell replaces itself with simple commands, and stays around for anything else
+		if argvMatches(cmdline, []string{"sh", "-c", "exec " + command}) {
+			return true
+		}
+		words, ok := shellWords(command)
+		return ok && argvMatches(cmdline, words)
+	}
+	// Any ssh executable, see `--ssh-exec`
+	return argvMatches(cmdline, append([]string{"", "-v"}, t.sshArgs()...))
+}
+
+// The status of a tunnel whose process is running
+// Remote tunnels listen on the remote host, so they are assumed up once running. ssh exits if
+// it can't set up a forward (see `sshCommand`), so this only hides the initial connection time.
+func (t *Tunnel) runningStatus() string {
+	if t.IsRemote() || t.ForwardsInUse() {
+		return StatusUp
+	}
+	return StatusStarting
+}
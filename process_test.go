@@ -0,0 +1,62 @@
+package tnnlr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShellWords(t *testing.T) {
+	cases := []struct {
+		command string
+		words   []string
+	}{
+		{"kubectl port-forward svc/web 8080:80", []string{"kubectl", "port-forward", "svc/web", "8080:80"}},
+		{`kubectl  --context "it's prod" 'a b'c`, []string{"kubectl", "--context", "it's prod", "a bc"}},
+		{`echo "a \"b\" \x" a\ b ''`, []string{"echo", `a "b" \x`, "a b", ""}},
+		{"cmd | tee log", nil},
+		{"cmd $HOME", nil},
+		{"FOO=1 cmd", nil},
+		{"cmd 'unterminated", nil},
+		{"", nil},
+	}
+	for _, c := range cases {
+		words, ok := shellWords(c.command)
+		if ok != (c.words != nil) || !reflect.DeepEqual(words, c.words) {
+			t.Errorf("shellWords(%q) is %q (%v), expected %q", c.command, words, ok, c.words)
+		}
+	}
+}
+
+func TestRunsCmdline(t *testing.T) {
+	ssh := &Tunnel{Name: "web", Host: "example.com", LocalPort: 8080, RemotePort: 80}
+	otherSsh := &Tunnel{Name: "web", Host: "example.com", LocalPort: 8081, RemotePort: 80}
+	exec := &Tunnel{Name: "grafana", Backend: BackendExec, LocalPort: 3000, RemotePort: 80, Command: `kubectl port-forward svc/grafana {{.LocalPort}}:{{.RemotePort}} --context "it's prod"`}
+	script := &Tunnel{Name: "stub", Backend: BackendExec, LocalPort: 3000, Command: "'/tmp/stub forward.sh' {{.LocalPort}} | tee log"}
+
+	sshArgs := append([]string{"-v"}, ssh.sshArgs()...)
+	cases := []struct {
+		tnnl    *Tunnel
+		cmdline []string
+		runs    bool
+	}{
+		{ssh, append([]string{"ssh"}, sshArgs...), true},
+		{ssh, append([]string{"/usr/local/bin/my-ssh"}, sshArgs...), true},
+		{otherSsh, append([]string{"ssh"}, sshArgs...), false},
+		{ssh, append([]string{"ssh"}, sshArgs[:len(sshArgs)-1]...), false},
+		{ssh, append([]string{"/bin/sh", "/usr/local/bin/ssh-wrapper"}, sshArgs...), true},
+		{ssh, append([]string{"ssh", "-o", "Foo=bar"}, sshArgs...), false},
+		{ssh, append([]string{"ssh", "-4"}, sshArgs...), false},
+		{exec, []string{"/usr/bin/kubectl", "port-forward", "svc/grafana", "3000:80", "--context", "it's prod"}, true},
+		{exec, []string{"kubectl", "port-forward", "svc/grafana", "3000:80", "--context", "it's", "prod"}, false},
+		{exec, []string{"kubectl", "port-forward", "svc/grafana", "3000:80"}, false},
+		{script, []string{"/bin/sh", "-c", "exec '/tmp/stub forward.sh' 3000 | tee log"}, true},
+		{script, []string{"/bin/sh", "-c", "exec '/tmp/stub forward.sh' 3001 | tee log"}, false},
+		{script, []string{"/bin/sh", "/tmp/stub forward.sh", "3000"}, false},
+		{ssh, nil, false},
+	}
+	for _, c := range cases {
+		if runs := c.tnnl.runsCmdline(c.cmdline); runs != c.runs {
+			t.Errorf("Tunnel '%s' running %q is %v, expected %v", c.tnnl.Name, c.cmdline, runs, c.runs)
+		}
+	}
+}
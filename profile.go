@@ -0,0 +1,258 @@
+package tnnlr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Profiles are named sets of tunnels, each loaded from and saved to its own tunnels file.
+
+The tunnels file given with `--tunnels` is the "default" profile, and more are added with
+`--profiles`, e.g. one per project or environment. Every profile is run by the same tnnlr, so they
+share the web UI and the bookkeeping dirs instead of several tnnlrs fighting over `~/.tnnlr/proc`.
+*/
+
+// The profile of the tunnels file given with `--tunnels`
+const DefaultProfile = "default"
+
+type Profile struct {
+	Name   string
+	File   string
+	Format string       // format of the file, detected from the extension if ""
+	source *sourceState // the last run of the file's source, see source.go
+	// Timeout and refresh for a file that is an executable, which can't set its own
+	sourceTimeout int
+	sourceRefresh int
+}
+
+// Parse a comma separated list of profiles, e.g. "staging=staging.yaml,prod=prod.json"
+func ParseProfiles(spec string) ([]Profile, error) {
+	var profiles []Profile
+	for _, item := range splitList([]string{spec}) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("Invalid profile '%s', expected name=file", item)
+		}
+		profiles = append(profiles, Profile{
+			Name: strings.TrimSpace(parts[0]),
+			File: strings.TrimSpace(parts[1]),
+		})
+	}
+	return profiles, nil
+}
+
+// The format of the profile's file, from `Format` or else the file extension
+func (p *Profile) fileFormat() string {
+	if p.Format != "" {
+		return p.Format
+	}
+	switch strings.ToLower(filepath.Ext(p.File)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatJSON
+}
+
+// Load the profile's tunnels from disk, or from the file's source
+// Problems with the tunnels are returned as `ValidationErrors`, along with the tunnels.
+func (p *Profile) Load() ([]Tunnel, error) {
+	// Load from file, or from running it
+	var raw []byte
+	var err error
+	format := p.fileFormat()
+	if p.isExecutable() {
+		var s Source
+		if s, err = p.executableSource(); err == nil {
+			raw, err = p.runSource(s)
+		}
+		format = FormatJSON
+	} else {
+		raw, err = ioutil.ReadFile(p.File)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Load all tunnels
+	doc, err := decodeTunnelsFile(raw, format)
+	if err != nil {
+		return nil, err
+	}
+	errs := unknownFields(raw, format)
+	tmpTunnels := doc.Tunnels
+	fromFile := len(tmpTunnels)
+	if doc.Source != nil {
+		if srcErrs := doc.Source.validationErrors(); len(srcErrs) > 0 {
+			return nil, srcErrs
+		}
+		output, err := p.runSource(*doc.Source)
+		if err != nil {
+			return nil, err
+		}
+		srcDoc, _ := decodeTunnelsFile(output, FormatJSON)
+		errs = append(errs, unknownFields(output, FormatJSON).withIndexOffset(fromFile)...)
+		tmpTunnels = append(tmpTunnels, srcDoc.Tunnels...)
+	}
+	for i := range tmpTunnels {
+		tmpTunnels[i].profile = p.Name
+	}
+	errs = append(errs, expandTunnels(tmpTunnels, doc.Variables)...)
+	errs = append(errs, ValidateTunnels(tmpTunnels)...)
+	errs = errs.fromSource(fromFile)
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool {
+			return errs[i].Index < errs[j].Index
+		})
+		return tmpTunnels, errs
+	}
+	return tmpTunnels, nil
+}
+
+// Write tunnels to the profile's file
+// Comments, variables and the order of tunnels already in the file are kept, see `parseComments`
+// and `restorePlaceholders`.
+// Tunnels from the file's source are left out, as they are written by the source.
+func (p *Profile) Save(tunnels []*Tunnel) error {
+	if p.isExecutable() {
+		return fmt.Errorf("%s is an executable, so its tunnels can't be saved", p.File)
+	}
+	format := p.fileFormat()
+	var comments fileComments
+	var existing tunnelsFile
+	if raw, err := ioutil.ReadFile(p.File); err == nil {
+		comments = parseComments(raw, format)
+		existing, _ = decodeTunnelsFile(raw, format)
+	}
+	if existing.Source != nil {
+		var fromFile []*Tunnel
+		for _, tnnl := range tunnels {
+			if !p.fromSource(tnnl.Name) {
+				fromFile = append(fromFile, tnnl)
+			}
+		}
+		tunnels = fromFile
+	}
+	comments.sortTunnels(tunnels)
+
+	encoded, err := encodeTunnels(restorePlaceholders(tunnels, existing), existing, format)
+	if err != nil {
+		return fmt.Errorf("Failed to encode tunnels as %s: %s", format, err.Error())
+	}
+	return ioutil.WriteFile(p.File, comments.apply(encoded, format), 0644)
+}
+
+// Set up the default profile and any others from `Profiles`
+func (t *Tnnlr) initProfiles() error {
+	t.profiles = []*Profile{{
+		Name:          DefaultProfile,
+		File:          t.TunnelReloadFile,
+		Format:        t.Format,
+		source:        &sourceState{},
+		sourceTimeout: t.SourceTimeout,
+		sourceRefresh: t.SourceRefresh,
+	}}
+	for i := range t.Profiles {
+		p := t.Profiles[i]
+		if _, err := t.profile(p.Name); err == nil {
+			return fmt.Errorf("Profile '%s' is listed more than once", p.Name)
+		}
+		if err := validateFormat(p.Format); err != nil {
+			return err
+		}
+		p.source = &sourceState{}
+		p.sourceTimeout, p.sourceRefresh = t.SourceTimeout, t.SourceRefresh
+		t.profiles = append(t.profiles, &p)
+	}
+	return nil
+}
+
+// Look up a profile for a command run without the server, setting up profiles if `Init` hasn't
+func (t *Tnnlr) commandProfile(name string) (*Profile, error) {
+	if t.profiles == nil {
+		if t.TunnelReloadFile == "" {
+			t.TunnelReloadFile = ".tnnlr"
+		}
+		if err := validateFormat(t.Format); err != nil {
+			return nil, err
+		}
+		if err := t.initProfiles(); err != nil {
+			return nil, err
+		}
+	}
+	return t.profile(name)
+}
+
+// Look up a profile by name, with "" meaning the default profile
+func (t *Tnnlr) profile(name string) (*Profile, error) {
+	if name == "" {
+		name = DefaultProfile
+	}
+	for _, p := range t.profiles {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown profile '%s'", name)
+}
+
+// The profile named by a request's "profile" parameter, or the default profile
+func (t *Tnnlr) requestProfile(c *gin.Context) (*Profile, error) {
+	return t.profile(c.DefaultPostForm("profile", c.Query("profile")))
+}
+
+// The managed tunnels belonging to a profile
+func (t *Tnnlr) ProfileTunnels(name string) map[string]*Tunnel {
+	tunnels := make(map[string]*Tunnel)
+	for tnnlId, tnnl := range t.ManagedTunnels() {
+		if tnnl.Profile() == name {
+			tunnels[tnnlId] = tnnl
+		}
+	}
+	return tunnels
+}
+
+// Stop and remove all the tunnels of a profile
+func (t *Tnnlr) StopProfile(name string) int {
+	tunnels := t.ProfileTunnels(name)
+	for tnnlId := range tunnels {
+		t.RemoveTunnel(tnnlId)
+	}
+	return len(tunnels)
+}
+
+// Save the tunnels of a profile to its file
+func (t *Tnnlr) SaveProfile(p *Profile) error {
+	var tmpTunnels []*Tunnel
+	for _, tnnl := range t.ProfileTunnels(p.Name) {
+		tmpTunnels = append(tmpTunnels, tnnl)
+	}
+	return p.Save(tmpTunnels)
+}
+
+// Stop all tunnels of a profile
+func (t *Tnnlr) StopAll(c *gin.Context) {
+	p, err := t.requestProfile(c)
+	if err != nil {
+		t.AddMessage(err.Error())
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	n := t.StopProfile(p.Name)
+	log.WithFields(log.Fields{
+		"profile": p.Name,
+		"stopped": n,
+	}).Info("Stopped profile")
+	t.AddMessage(fmt.Sprintf("Stopped %d tunnels of profile '%s'", n, p.Name))
+	c.Redirect(http.StatusFound, "/")
+}
@@ -0,0 +1,247 @@
+package tnnlr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"labix.org/v2/mgo/bson"
+)
+
+/*
+Reloading the tunnels file without disturbing tunnels that haven't changed.
+
+Tunnels in the file are matched to managed tunnels by id, or by name for tunnels without an id.
+Matched tunnels are compared by a hash of their definition, so only new, removed and changed
+tunnels are touched and connections through the others stay up.  Changed tunnels are only restarted
+if something about their connection changed, and are otherwise updated in place.
+*/
+
+// Reconcile actions
+const (
+	ActionStart   = "start"
+	ActionStop    = "stop"
+	ActionRestart = "restart"
+	ActionUpdate  = "update" // changed, but not in a way that needs a restart
+	ActionKeep    = "keep"
+)
+
+// A single step of a reload
+type ReconcileAction struct {
+	Action  string   `json:"action"`
+	Id      string   `json:"id"`
+	Name    string   `json:"name"`
+	Changes []string `json:"changes,omitempty"` // fields that changed, for restarts and updates
+	Error   string   `json:"error,omitempty"`   // why the action failed, once applied
+	tunnel  Tunnel   // the definition to start or update to
+}
+
+// The tunnel as json, without its id and process state
+func (t *Tunnel) definitionJSON() []byte {
+	definition := *t
+	definition.Id, definition.Pid = "", 0
+	tJSON, _ := json.Marshal(definition)
+	return tJSON
+}
+
+// The tunnel as json, with only the fields that affect its connection
+// Names, default URLs, proxy patterns and restart settings can change without restarting the tunnel.
+func (t *Tunnel) connectionJSON() []byte {
+	connection := *t
+	connection.Id, connection.Pid = "", 0
+	connection.Type = t.Kind()
+	connection.Name, connection.DefaultUrl, connection.ProxyPatterns = "", "", nil
+	connection.Autostart, connection.Restart = false, ""
+	connection.MaxRetries, connection.RestartBackoff, connection.RestartBackoffMax = 0, 0, 0
+	connection.Forwards = nil
+	for _, f := range t.Forwards {
+		f.DefaultUrl = ""
+		connection.Forwards = append(connection.Forwards, f)
+	}
+	tJSON, _ := json.Marshal(connection)
+	return tJSON
+}
+
+// Whether going from one definition of a tunnel to another needs its process restarted
+func connectionChanged(a, b *Tunnel) bool {
+	if !bytes.Equal(a.connectionJSON(), b.connectionJSON()) {
+		return true
+	}
+	// The command of an exec tunnel can use any field
+	if b.Backend == BackendExec {
+		aCommand, _ := a.renderCommand()
+		bCommand, _ := b.renderCommand()
+		return aCommand != bCommand
+	}
+	return false
+}
+
+// A hash of the tunnel's definition
+func (t *Tunnel) ContentHash() string {
+	sum := sha256.Sum256(t.definitionJSON())
+	return hex.EncodeToString(sum[:])
+}
+
+// The names of the json fields that differ between two tunnels
+func changedFields(a, b *Tunnel) []string {
+	var aFields, bFields map[string]interface{}
+	json.Unmarshal(a.definitionJSON(), &aFields)
+	json.Unmarshal(b.definitionJSON(), &bFields)
+
+	var changes []string
+	for k, v := range aFields {
+		if !reflect.DeepEqual(v, bFields[k]) {
+			changes = append(changes, k)
+		}
+	}
+	for k := range bFields {
+		if _, ok := aFields[k]; !ok {
+			changes = append(changes, k)
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// Work out what it takes to go from the managed tunnels of a profile to the desired ones
+// Starts and restarts are listed in the order of desired, followed by stops.
+func (t *Tnnlr) PlanReconcile(p *Profile, desired []Tunnel) []ReconcileAction {
+	all := t.ManagedTunnels()
+	managed := t.ProfileTunnels(p.Name)
+	byName := make(map[string]*Tunnel)
+	for _, tnnl := range managed {
+		byName[tnnl.Name] = tnnl
+	}
+
+	var plan []ReconcileAction
+	seen := make(map[string]bool)
+	for _, tnnl := range desired {
+		current, ok := managed[tnnl.Id]
+		if !ok && tnnl.Id == "" {
+			current, ok = byName[tnnl.Name]
+		}
+		switch {
+		case ok:
+			tnnl.Id = current.Id
+		case tnnl.Id == "":
+			tnnl.Id = bson.NewObjectId().Hex()
+		}
+		if seen[tnnl.Id] {
+			log.WithFields(log.Fields{
+				"id":   tnnl.Id,
+				"name": tnnl.Name,
+			}).Warn("Tunnel is listed more than once, ignoring all but the first")
+			continue
+		}
+		if other, ok := all[tnnl.Id]; ok && other.Profile() != p.Name {
+			log.WithFields(log.Fields{
+				"id":      tnnl.Id,
+				"name":    tnnl.Name,
+				"profile": other.Profile(),
+			}).Warn("Tunnel id is already used by another profile, ignoring")
+			continue
+		}
+		seen[tnnl.Id] = true
+
+		action := ReconcileAction{
+			Action: ActionStart,
+			Id:     tnnl.Id,
+			Name:   tnnl.Name,
+			tunnel: tnnl,
+		}
+		if ok {
+			action.Action = ActionKeep
+			if current.ContentHash() != tnnl.ContentHash() {
+				action.Action = ActionUpdate
+				// Stopped tunnels stay stopped, like when editing them
+				if connectionChanged(current, &tnnl) && !current.isStopped() {
+					action.Action = ActionRestart
+				}
+				action.Changes = changedFields(current, &tnnl)
+			}
+			if current.isCrashLooping() {
+				// Reloading is how a tunnel gets another chance
+				action.Action = ActionRestart
+			}
+		}
+		plan = append(plan, action)
+	}
+
+	var stops []ReconcileAction
+	for tnnlId, tnnl := range managed {
+		if !seen[tnnlId] {
+			stops = append(stops, ReconcileAction{
+				Action: ActionStop,
+				Id:     tnnlId,
+				Name:   tnnl.Name,
+			})
+		}
+	}
+	sort.Slice(stops, func(i, j int) bool {
+		return stops[i].Name < stops[j].Name
+	})
+	return append(plan, stops...)
+}
+
+// Whether applying the plan would start or stop anything
+func planHasChanges(plan []ReconcileAction) bool {
+	for _, action := range plan {
+		if action.Action != ActionKeep {
+			return true
+		}
+	}
+	return false
+}
+
+// Carry out a plan from `PlanReconcile`
+// Failures are reported through the message queue and set on the failed actions, and don't stop the
+// rest of the plan.  The file was checked as a whole when it was loaded, so tunnels aren't checked
+// against the ones the plan is about to stop or change.
+func (t *Tnnlr) ApplyReconcile(p *Profile, plan []ReconcileAction) {
+	counts := make(map[string]int)
+	for i := range plan {
+		action := &plan[i]
+		log.WithFields(log.Fields{
+			"action":  action.Action,
+			"id":      action.Id,
+			"name":    action.Name,
+			"changes": action.Changes,
+		}).Debug("Reconciling tunnel")
+
+		var err error
+		switch action.Action {
+		case ActionStop:
+			t.RemoveTunnel(action.Id)
+		case ActionRestart, ActionUpdate:
+			// A tunnel that fails to restart stays managed, and is restarted following its restart policy
+			var restarted bool
+			_, restarted, err = t.updateTunnel(action.Id, action.tunnel, false)
+			if err == nil && action.Action == ActionRestart && !restarted {
+				// Crash-looping, but unchanged
+				err = t.RestartTunnel(action.Id)
+			}
+		case ActionStart:
+			err = t.addTunnel(action.tunnel, false)
+		}
+		if err != nil {
+			message := fmt.Sprintf("Failed to %s tunnel '%s': %s", action.Action, action.Name, err.Error())
+			log.WithFields(log.Fields{
+				"err":  err.Error(),
+				"id":   action.Id,
+				"name": action.Name,
+			}).Error(message)
+			t.AddMessage(message)
+			action.Error = err.Error()
+			continue
+		}
+		counts[action.Action]++
+	}
+
+	t.AddMessage(fmt.Sprintf("Reloaded tunnels from file %s: %d started, %d restarted, %d updated, %d stopped, %d unchanged",
+		p.File, counts[ActionStart], counts[ActionRestart], counts[ActionUpdate], counts[ActionStop], counts[ActionKeep]))
+}
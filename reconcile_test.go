@@ -0,0 +1,115 @@
+package tnnlr
+
+import (
+	"testing"
+)
+
+func TestConnectionChanged(t *testing.T) {
+	base := Tunnel{Name: "web", Host: "example.com", LocalPort: 8080, RemotePort: 80, Forwards: []Forward{{LocalPort: 9200, RemotePort: 9200}}}
+	exec := Tunnel{Name: "grafana", Backend: BackendExec, Host: "prod", LocalPort: 3000, RemotePort: 80, Command: "kubectl port-forward --context {{.Host}} svc/grafana {{.LocalPort}}:{{.RemotePort}}"}
+	cases := []struct {
+		name    string
+		a       Tunnel
+		change  func(t *Tunnel)
+		changed bool
+	}{
+		{"nothing", base, func(t *Tunnel) {}, false},
+		{"name", base, func(t *Tunnel) { t.Name = "www" }, false},
+		{"default url", base, func(t *Tunnel) { t.DefaultUrl = "/admin" }, false},
+		{"restart policy", base, func(t *Tunnel) { t.Restart, t.RestartBackoff = RestartNever, 10 }, false},
+		{"forward default url", base, func(t *Tunnel) { t.Forwards = []Forward{{LocalPort: 9200, RemotePort: 9200, DefaultUrl: "/"}} }, false},
+		{"extra forward", base, func(t *Tunnel) { t.Forwards = append(t.Forwards, Forward{LocalPort: 9300, RemotePort: 9300}) }, true},
+		{"default type", base, func(t *Tunnel) { t.Type = TunnelTypeLocal }, false},
+		{"local port", base, func(t *Tunnel) { t.LocalPort = 8081 }, true},
+		{"host", base, func(t *Tunnel) { t.Host = "example.org" }, true},
+		{"jump hosts", base, func(t *Tunnel) { t.JumpHosts = []string{"bastion"} }, true},
+		{"exec name", exec, func(t *Tunnel) { t.Name = "grafana prod" }, false},
+		{"exec host in command", exec, func(t *Tunnel) { t.Host = "staging" }, true},
+		{"exec command", exec, func(t *Tunnel) { t.Command += " --address 0.0.0.0" }, true},
+	}
+	for _, c := range cases {
+		b := c.a
+		c.change(&b)
+		if changed := connectionChanged(&c.a, &b); changed != c.changed {
+			t.Errorf("Changing %s gives connectionChanged %v, expected %v", c.name, changed, c.changed)
+		}
+	}
+}
+
+func TestPlanReconcile(t *testing.T) {
+	running := map[string]*Tunnel{
+		"a": {Id: "a", Name: "web", Host: "example.com", LocalPort: 8080, RemotePort: 80},
+		"b": {Id: "b", Name: "db", Host: "example.com", LocalPort: 5432, RemotePort: 5432},
+		"c": {Id: "c", Name: "cache", Host: "example.com", LocalPort: 6379, RemotePort: 6379},
+		"o": {Id: "o", Name: "other", Host: "example.com", LocalPort: 9000, RemotePort: 80, profile: "work"},
+		"s": {Id: "s", Name: "stopped", Host: "example.com", LocalPort: 9001, RemotePort: 80, restarts: &restartState{stopped: true}},
+	}
+	cases := []struct {
+		name    string
+		desired []Tunnel
+		actions []string // action:name for each step, in order
+	}{
+		{
+			"unchanged by name",
+			[]Tunnel{
+				{Name: "web", Host: "example.com", LocalPort: 8080, RemotePort: 80},
+				{Name: "db", Host: "example.com", LocalPort: 5432, RemotePort: 5432},
+			},
+			[]string{"keep:web", "keep:db", "stop:cache", "stop:stopped"},
+		},
+		{
+			// The id wins over the name, so this renames "db", and the tunnel without an id is "web"
+			"id before name",
+			[]Tunnel{
+				{Id: "b", Name: "web", Host: "example.com", LocalPort: 5432, RemotePort: 5432},
+				{Name: "web", Host: "example.com", LocalPort: 8080, RemotePort: 80},
+			},
+			[]string{"update:web", "keep:web", "stop:cache", "stop:stopped"},
+		},
+		{
+			// Unknown ids aren't matched by name
+			"unknown id",
+			[]Tunnel{{Id: "x", Name: "web", Host: "example.com", LocalPort: 8080, RemotePort: 80}},
+			[]string{"start:web", "stop:cache", "stop:db", "stop:stopped", "stop:web"},
+		},
+		{
+			"connection changes",
+			[]Tunnel{
+				{Name: "web", Host: "example.com", LocalPort: 8081, RemotePort: 80},
+				{Name: "stopped", Host: "example.com", LocalPort: 9002, RemotePort: 80},
+			},
+			[]string{"restart:web", "update:stopped", "stop:cache", "stop:db"},
+		},
+		{
+			"listed twice",
+			[]Tunnel{
+				{Name: "web", Host: "example.com", LocalPort: 8080, RemotePort: 80},
+				{Id: "a", Name: "web", Host: "example.com", LocalPort: 8081, RemotePort: 80},
+			},
+			[]string{"keep:web", "stop:cache", "stop:db", "stop:stopped"},
+		},
+		{
+			"id from another profile",
+			[]Tunnel{{Id: "o", Name: "other", Host: "example.com", LocalPort: 9000, RemotePort: 80}},
+			[]string{"stop:cache", "stop:db", "stop:stopped", "stop:web"},
+		},
+	}
+	for _, c := range cases {
+		tnnlr := &Tnnlr{tunnels: running}
+		plan := tnnlr.PlanReconcile(&Profile{Name: DefaultProfile}, c.desired)
+		var actions []string
+		for _, action := range plan {
+			actions = append(actions, action.Action+":"+action.Name)
+		}
+		if len(actions) != len(c.actions) {
+			t.Errorf("Plan for %s is %v, expected %v", c.name, actions, c.actions)
+			continue
+		}
+		for i := range actions {
+			if actions[i] != c.actions[i] {
+				t.Errorf("Plan for %s is %v, expected %v", c.name, actions, c.actions)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package tnnlr
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Restarting managed tunnels when they die.
+
+Each restart in a row waits twice as long as the one before, with some jitter so tunnels to the same
+host don't all reconnect at once.  A tunnel that stays up for a while is considered healthy again.
+A tunnel that keeps dying is marked as crash-looping and left down until it is reloaded.
+*/
+
+// Restart policies
+const (
+	RestartAlways    = "always"     // restart whenever the tunnel dies (default)
+	RestartOnFailure = "on-failure" // restart unless the process exited cleanly
+	RestartNever     = "never"
+)
+
+// Given up on after too many restarts in a row
+const StatusCrashLooping = "crash-looping"
+
+// Stopped on request, and left down until started again
+const StatusStopped = "stopped"
+
+const (
+	defaultMaxRetries        = 5
+	defaultRestartBackoff    = 1   // seconds
+	defaultRestartBackoffMax = 300 // seconds
+	// Longer backoffs are rejected, and would overflow once doubled
+	maxRestartBackoff = 24 * 60 * 60 // seconds
+	// Tunnels that stay up this long before dying start again from the initial backoff
+	restartStableAfter = 1 * time.Minute
+)
+
+// Restart bookkeeping for a managed tunnel
+type restartState struct {
+	sync.Mutex
+	startedAt    time.Time
+	restarts     int       // total restarts
+	failures     int       // deaths in a row, each within restartStableAfter of starting
+	lastExit     string    // why the tunnel last died
+	runErr       error     // set when the last restart failed to launch
+	nextRestart  time.Time // set once the tunnel is found dead
+	givenUp      bool      // the policy says not to restart
+	crashLooping bool
+	stopped      bool // stopped on request
+}
+
+func newRestartState() *restartState {
+	return &restartState{startedAt: time.Now()}
+}
+
+// Start counting from scratch, for a tunnel started again by hand
+func (r *restartState) reset() {
+	r.Lock()
+	defer r.Unlock()
+	r.startedAt = time.Now()
+	r.failures = 0
+	r.runErr = nil
+	r.nextRestart = time.Time{}
+	r.givenUp, r.crashLooping, r.stopped = false, false, false
+}
+
+func validateRestartPolicy(t *Tunnel) ValidationErrors {
+	var errs ValidationErrors
+	switch t.Restart {
+	case "", RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		errs = append(errs, ValidationError{Index: -1, Field: "restart", Message: fmt.Sprintf("Unknown restart policy '%s'", t.Restart)})
+	}
+	if t.MaxRetries < -1 {
+		errs = append(errs, ValidationError{Index: -1, Field: "maxRetries", Message: "Max retries must be -1 (no limit) or more"})
+	}
+	if t.RestartBackoff < 0 || t.RestartBackoff > maxRestartBackoff {
+		errs = append(errs, ValidationError{Index: -1, Field: "restartBackoff", Message: fmt.Sprintf("Restart backoff must be between 0 and %d seconds", maxRestartBackoff)})
+	}
+	if t.RestartBackoffMax < 0 || t.RestartBackoffMax > maxRestartBackoff {
+		errs = append(errs, ValidationError{Index: -1, Field: "restartBackoffMax", Message: fmt.Sprintf("Restart backoff must be between 0 and %d seconds", maxRestartBackoff)})
+	}
+	return errs
+}
+
+func (t *Tunnel) restartPolicy() string {
+	if t.Restart == "" {
+		return RestartAlways
+	}
+	return t.Restart
+}
+
+func (t *Tunnel) maxRetries() int {
+	if t.MaxRetries == 0 {
+		return defaultMaxRetries
+	}
+	return t.MaxRetries
+}
+
+// How long to wait before the nth restart in a row
+// The full exponential delay is used as an upper bound, and the actual delay is picked from its top half.
+func (t *Tunnel) restartDelay(n int) time.Duration {
+	backoff, backoffMax := t.RestartBackoff, t.RestartBackoffMax
+	if backoff == 0 {
+		backoff = defaultRestartBackoff
+	}
+	if backoffMax == 0 {
+		backoffMax = defaultRestartBackoffMax
+	}
+	// Tunnels are validated before they are run, but an overflow here would crash the supervisor
+	if backoff > maxRestartBackoff {
+		backoff = maxRestartBackoff
+	}
+	if backoffMax > maxRestartBackoff {
+		backoffMax = maxRestartBackoff
+	}
+	delay := time.Duration(backoff) * time.Second
+	for i := 1; i < n && delay < time.Duration(backoffMax)*time.Second; i++ {
+		delay *= 2
+	}
+	if delay > time.Duration(backoffMax)*time.Second {
+		delay = time.Duration(backoffMax) * time.Second
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Whether the tunnel went down without an error
+func (t *Tunnel) exitedCleanly() bool {
+	if t.proc != nil {
+		return t.proc.ExitCode() == 0
+	}
+	if t.native != nil {
+		return t.native.Err() == nil
+	}
+	return false
+}
+
+func (t *Tunnel) isCrashLooping() bool {
+	if t.restarts == nil {
+		return false
+	}
+	t.restarts.Lock()
+	defer t.restarts.Unlock()
+	return t.restarts.crashLooping
+}
+
+func (t *Tunnel) isStopped() bool {
+	if t.restarts == nil {
+		return false
+	}
+	t.restarts.Lock()
+	defer t.restarts.Unlock()
+	return t.restarts.stopped
+}
+
+// Restart counts, why the tunnel last died and when it will be restarted, for display
+func (t *Tunnel) RestartInfo() string {
+	if t.restarts == nil {
+		return ""
+	}
+	r := t.restarts
+	r.Lock()
+	defer r.Unlock()
+	if r.restarts == 0 && r.lastExit == "" {
+		return ""
+	}
+	info := fmt.Sprintf("restarts: %d", r.restarts)
+	if r.lastExit != "" {
+		info += fmt.Sprintf(", last exit: %s", r.lastExit)
+	}
+	switch {
+	case r.stopped:
+	case r.crashLooping:
+		info += ", not restarting until reloaded"
+	case r.givenUp:
+		info += fmt.Sprintf(", not restarting (policy '%s')", t.restartPolicy())
+	case !r.nextRestart.IsZero():
+		// Rounded to the second
+		wait := (time.Until(r.nextRestart) + time.Second/2) / time.Second * time.Second
+		info += fmt.Sprintf(", restarting in %s", wait)
+	}
+	return info
+}
+
+// Restart a managed tunnel if it has died, following its restart policy
+// Called periodically, so a dead tunnel is first scheduled for a restart and restarted on a later call.
+func (t *Tnnlr) superviseTunnel(tnnl *Tunnel) {
+	if tnnl.restarts == nil || tnnl.Status() != StatusDead {
+		return
+	}
+	r := tnnl.restarts
+	r.Lock()
+	defer r.Unlock()
+	if r.givenUp || r.crashLooping || r.stopped {
+		return
+	}
+
+	now := time.Now()
+	if r.nextRestart.IsZero() {
+		// Just died
+		r.lastExit = tnnl.ConnectionState()
+		if r.runErr != nil {
+			r.lastExit = r.runErr.Error()
+			r.runErr = nil
+		}
+		if now.Sub(r.startedAt) >= restartStableAfter {
+			r.failures = 0
+		}
+		r.failures++
+
+		fields := log.Fields{
+			"id":     tnnl.Id,
+			"name":   tnnl.Name,
+			"reason": r.lastExit,
+		}
+		policy := tnnl.restartPolicy()
+		if policy == RestartNever || (policy == RestartOnFailure && tnnl.exitedCleanly()) {
+			r.givenUp = true
+			log.WithFields(fields).Info("Tunnel died, not restarting")
+			return
+		}
+		if max := tnnl.maxRetries(); max >= 0 && r.failures > max {
+			r.crashLooping = true
+			log.WithFields(fields).Error("Tunnel is crash-looping, not restarting until reloaded")
+			t.AddMessage(fmt.Sprintf("Tunnel '%s' is crash-looping: %s", tnnl.Name, r.lastExit))
+			return
+		}
+		delay := tnnl.restartDelay(r.failures)
+		r.nextRestart = now.Add(delay)
+		fields["delay"] = delay.String()
+		log.WithFields(fields).Info("Tunnel died, restarting")
+		return
+	}
+
+	if now.Before(r.nextRestart) {
+		return
+	}
+	r.nextRestart = time.Time{}
+	r.restarts++
+	r.startedAt = now
+	log.WithFields(log.Fields{
+		"id":       tnnl.Id,
+		"name":     tnnl.Name,
+		"restarts": r.restarts,
+	}).Info("Restarting tunnel")
+	if err := tnnl.Run(t.backendFor(tnnl)); err != nil {
+		// Counts as another death on the next check
+		r.runErr = err
+		log.WithFields(log.Fields{
+			"id":  tnnl.Id,
+			"err": err,
+		}).Error("Failed to restart tunnel")
+	}
+}
+
+// Check on managed tunnels every second, restarting them as needed
+// Each tunnel is claimed while it is checked, so tunnels aren't restarted after being removed, and
+// tunnels that are being started or stopped elsewhere are left for the next check.
+func (t *Tnnlr) SuperviseTunnels() {
+	for {
+		time.Sleep(1 * time.Second)
+		for _, tnnl := range t.ManagedTunnels() {
+			if !t.tryClaim(tnnl) {
+				continue
+			}
+			t.superviseTunnel(tnnl)
+			t.release(tnnl.Id)
+		}
+	}
+}
+
+// Claim a tunnel, unless something else is starting or stopping it, it is no longer managed, or
+// tnnlr is shutting down
+// Threadsafe
+func (t *Tnnlr) tryClaim(tnnl *Tunnel) bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.shuttingDown || t.busy[tnnl.Id] || t.tunnels[tnnl.Id] != tnnl {
+		return false
+	}
+	t.busy[tnnl.Id] = true
+	return true
+}
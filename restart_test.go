@@ -0,0 +1,68 @@
+package tnnlr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartDelay(t *testing.T) {
+	maxInt := int(^uint(0) >> 1)
+	day := time.Duration(maxRestartBackoff) * time.Second
+	cases := []struct {
+		backoff, backoffMax int
+		n                   int
+		want                time.Duration // the delay before jitter, which takes off up to half
+	}{
+		{0, 0, 1, 1 * time.Second},
+		{0, 0, 4, 8 * time.Second},
+		{0, 0, 70, 300 * time.Second},
+		{5, 0, 2, 10 * time.Second},
+		{5, 12, 3, 12 * time.Second},
+		{600, 60, 1, 60 * time.Second},
+		{0, maxInt, 70, day},
+		{maxInt, maxInt, 1, day},
+		{maxInt, 0, 70, 300 * time.Second},
+	}
+	for _, c := range cases {
+		tnnl := Tunnel{RestartBackoff: c.backoff, RestartBackoffMax: c.backoffMax}
+		for i := 0; i < 10; i++ {
+			delay := tnnl.restartDelay(c.n)
+			if delay < c.want/2 || delay > c.want {
+				t.Errorf("restartDelay(%d) with backoff %d and max %d is %s, expected between %s and %s",
+					c.n, c.backoff, c.backoffMax, delay, c.want/2, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestValidateRestartPolicy(t *testing.T) {
+	cases := []struct {
+		tnnl   Tunnel
+		fields []string
+	}{
+		{Tunnel{}, nil},
+		{Tunnel{Restart: RestartOnFailure, MaxRetries: -1, RestartBackoff: 5, RestartBackoffMax: maxRestartBackoff}, nil},
+		{Tunnel{Restart: "sometimes"}, []string{"restart"}},
+		{Tunnel{MaxRetries: -2}, []string{"maxRetries"}},
+		{Tunnel{RestartBackoff: -1, RestartBackoffMax: -1}, []string{"restartBackoff", "restartBackoffMax"}},
+		{Tunnel{RestartBackoff: maxRestartBackoff + 1, RestartBackoffMax: 9000000}, []string{"restartBackoff", "restartBackoffMax"}},
+	}
+	for _, c := range cases {
+		errs := validateRestartPolicy(&c.tnnl)
+		var fields []string
+		for _, err := range errs {
+			fields = append(fields, err.Field)
+		}
+		if len(fields) != len(c.fields) {
+			t.Errorf("Restart settings %+v gave errors for %v, expected %v", c.tnnl, fields, c.fields)
+			continue
+		}
+		for i := range fields {
+			if fields[i] != c.fields[i] {
+				t.Errorf("Restart settings %+v gave errors for %v, expected %v", c.tnnl, fields, c.fields)
+				break
+			}
+		}
+	}
+}
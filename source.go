@@ -0,0 +1,279 @@
+package tnnlr
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Tunnels from an inventory command.
+
+Instead of listing tunnels, the tunnels file can be an executable, or have a `source` with a command
+to run. The command prints tunnels as json on stdout, in the same form as a json tunnels file, e.g.
+a script looking up the current bastion IPs in a cloud account. Tunnels from a `source` are added to
+any listed in the file itself.
+
+The command is run whenever the profile is loaded, and every `refresh` seconds if set. If it fails
+or times out, the last good output is used instead, so a flaky inventory doesn't take tunnels down.
+The last good output is also kept in `~/.tnnlr/inventory`, for when the command fails on startup.
+*/
+
+// Seconds to wait for a source command, unless the source sets its own timeout
+const defaultSourceTimeout = 30
+
+// How often to check whether a profile has a source to refresh
+const sourceCheckInterval = 10 * time.Second
+
+// A command printing tunnels as json
+type Source struct {
+	// Run with the system shell, from the directory of the tunnels file
+	Exec string `json:"exec" yaml:"exec" toml:"exec"`
+	// Seconds to wait for the command, defaults to 30
+	Timeout int `json:"timeout,omitempty" yaml:"timeout,omitempty" toml:"timeout,omitempty"`
+	// Seconds between runs of the command to pick up changes, 0 to only run it when reloading
+	Refresh int `json:"refresh,omitempty" yaml:"refresh,omitempty" toml:"refresh,omitempty"`
+}
+
+// Problems with the source, as fields of the tunnels file
+func (s *Source) validationErrors() ValidationErrors {
+	var errs ValidationErrors
+	if strings.TrimSpace(s.Exec) == "" {
+		errs = append(errs, ValidationError{-1, "source.exec", "Command is required for a source"})
+	}
+	if s.Timeout < 0 {
+		errs = append(errs, ValidationError{-1, "source.timeout", "Timeout can't be negative"})
+	}
+	if s.Refresh < 0 {
+		errs = append(errs, ValidationError{-1, "source.refresh", "Refresh can't be negative"})
+	}
+	return errs
+}
+
+// The last good output of a profile's source, and how the last run went
+type sourceState struct {
+	sync.Mutex
+	output  []byte
+	ranAt   time.Time // when output was produced
+	err     error     // why the last run failed, nil if it didn't
+	errAt   time.Time
+	tunnels map[string]bool // names of the tunnels in output
+}
+
+// Keep the output of a good run
+func (s *sourceState) use(output []byte, ranAt time.Time) {
+	s.output, s.ranAt = output, ranAt
+	doc, _ := decodeTunnelsFile(output, FormatJSON)
+	s.tunnels = make(map[string]bool)
+	for _, tnnl := range doc.Tunnels {
+		s.tunnels[tnnl.Name] = true
+	}
+}
+
+// Whether the profile's file is an executable to run rather than a tunnels file to read
+// Some filesystems (e.g. windows drives mounted in WSL) mark every file as executable, so the file
+// also has to look like one: a script with a "#!" line, or a binary.
+func (p *Profile) isExecutable() bool {
+	info, err := os.Stat(p.File)
+	if err != nil || !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+		return false
+	}
+	f, err := os.Open(p.File)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := f.Read(head)
+	head = head[:n]
+	return bytes.HasPrefix(head, []byte("#!")) || bytes.IndexByte(head, 0) >= 0
+}
+
+// The source of a profile whose file is an executable
+// Its timeout and refresh come from `--source-timeout` and `--source-refresh`.
+func (p *Profile) executableSource() (Source, error) {
+	path, err := filepath.Abs(p.File)
+	if err != nil {
+		return Source{}, err
+	}
+	return Source{Exec: shellQuote(path), Timeout: p.sourceTimeout, Refresh: p.sourceRefresh}, nil
+}
+
+// Where the last good output of the profile's source is kept between runs of tnnlr
+func (p *Profile) sourceCachePath() (string, error) {
+	dir, err := getRelativePath(relInventory)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, unsafeNameChars.ReplaceAllString(p.Name, "-")+".json"), nil
+}
+
+// Run a source command, returning what it printed
+// On timeout the command is killed along with anything it started, which also covers commands that
+// exit but leave something running with their output open.
+func runSourceCommand(s Source, dir string) ([]byte, error) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = defaultSourceTimeout
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", s.Exec)
+	} else {
+		cmd = exec.Command("sh", "-c", s.Exec)
+	}
+	cmd.Dir = dir
+	cmd.SysProcAttr = sourceAttr()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Command '%s' failed: %s", s.Exec, err.Error())
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(time.Duration(timeout) * time.Second):
+		killSourceCommand(cmd.Process)
+		// Don't wait long on anything that got away from the process group
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+		return nil, fmt.Errorf("Command '%s' timed out after %d seconds", s.Exec, timeout)
+	}
+	output := stdout.Bytes()
+	if err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = err.Error()
+		}
+		return nil, fmt.Errorf("Command '%s' failed: %s", s.Exec, message)
+	}
+	if _, err := decodeTunnelsFile(output, FormatJSON); err != nil {
+		return nil, fmt.Errorf("Command '%s' printed invalid json: %s", s.Exec, err.Error())
+	}
+	return output, nil
+}
+
+// Run the profile's source, falling back to the last good output if it fails
+// The command runs without the lock held, so showing the source's status doesn't wait on it.
+func (p *Profile) runSource(s Source) ([]byte, error) {
+	startedAt := time.Now()
+	output, err := runSourceCommand(s, filepath.Dir(p.File))
+	cachePath, pathErr := p.sourceCachePath()
+	if err == nil {
+		if pathErr == nil && createRelDir(relInventory) == nil {
+			ioutil.WriteFile(cachePath, output, 0600)
+		}
+		p.source.Lock()
+		defer p.source.Unlock()
+		// Unless a run that started later has already finished
+		if !p.source.ranAt.After(startedAt) {
+			p.source.use(output, startedAt)
+			p.source.err = nil
+		}
+		return output, nil
+	}
+
+	// Left by an earlier run of tnnlr
+	var cached []byte
+	var cachedAt time.Time
+	if pathErr == nil {
+		if info, statErr := os.Stat(cachePath); statErr == nil {
+			if raw, readErr := ioutil.ReadFile(cachePath); readErr == nil {
+				cached, cachedAt = raw, info.ModTime()
+			}
+		}
+	}
+
+	p.source.Lock()
+	defer p.source.Unlock()
+	p.source.err, p.source.errAt = err, time.Now()
+	if p.source.output == nil && cached != nil {
+		p.source.use(cached, cachedAt)
+	}
+	if p.source.output == nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"err":     err.Error(),
+		"profile": p.Name,
+		"ranAt":   p.source.ranAt,
+	}).Warn("Source failed, using its last good output")
+	return p.source.output, nil
+}
+
+// How the profile's source last ran, for display, or "" if it doesn't have one or it's fine
+func (p *Profile) SourceStatus() string {
+	p.source.Lock()
+	defer p.source.Unlock()
+	if p.source.err == nil {
+		return ""
+	}
+	status := fmt.Sprintf("Source failed at %s: %s", p.source.errAt.Format(time.RFC822), p.source.err.Error())
+	if p.source.output != nil {
+		status += fmt.Sprintf(", using its output from %s", p.source.ranAt.Format(time.RFC822))
+	}
+	return status
+}
+
+// Whether a tunnel came from the profile's source the last time it ran
+func (p *Profile) fromSource(name string) bool {
+	p.source.Lock()
+	defer p.source.Unlock()
+	return p.source.tunnels[name]
+}
+
+// The seconds between refreshes of the profile's source, or 0 if it shouldn't be refreshed
+func (p *Profile) refreshInterval() int {
+	if p.isExecutable() {
+		return p.sourceRefresh
+	}
+	doc, err := p.decode()
+	if err != nil || doc.Source == nil {
+		return 0
+	}
+	return doc.Source.Refresh
+}
+
+// Rerun a profile's source every `refresh` seconds, applying any changes to its tunnels
+// Like watching the file, only tunnels that were added, removed or changed are touched.
+func (t *Tnnlr) RefreshSource(p *Profile) {
+	for {
+		refresh := p.refreshInterval()
+		if refresh == 0 {
+			time.Sleep(sourceCheckInterval)
+			continue
+		}
+		time.Sleep(time.Duration(refresh) * time.Second)
+
+		tmpTunnels, err := p.Load()
+		if err != nil {
+			t.reportLoadError(p, "Failed to refresh tunnels from source, leaving tunnels as they are", err)
+			continue
+		}
+		t.reloadLock.Lock()
+		if plan := t.PlanReconcile(p, tmpTunnels); planHasChanges(plan) {
+			log.WithFields(log.Fields{
+				"profile": p.Name,
+			}).Info("Source changed")
+			t.ApplyReconcile(p, plan)
+		}
+		t.reloadLock.Unlock()
+	}
+}
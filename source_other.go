@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package tnnlr
+
+import (
+	"os"
+	"syscall"
+)
+
+// Run a source command in its own process group, so anything it starts can be killed with it
+func sourceAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Kill a source command along with anything it started
+func killSourceCommand(p *os.Process) {
+	syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
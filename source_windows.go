@@ -0,0 +1,16 @@
+package tnnlr
+
+import (
+	"os"
+	"syscall"
+)
+
+// Windows has no process groups to put a source command in
+func sourceAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+// Kill a source command, processes it started are left running
+func killSourceCommand(p *os.Process) {
+	p.Kill()
+}
@@ -0,0 +1,346 @@
+package tnnlr
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+/*
+Reading forwards out of an ssh config file, to import them as tunnels.
+
+Only what's needed for that is understood: `Host` sections with their patterns, `Include`, and the
+`HostName`, `User`, `Port` and forwarding options. `Match` sections are skipped. Options are looked
+up the way ssh does, so for each host the first value found in the file wins, while forwards from
+every matching section add up.
+
+Imported tunnels connect to the alias from the `Host` line rather than the resolved host name, so ssh
+still applies everything else in the config (keys, jump hosts, ...) when running them.
+*/
+
+// The default location of the user's ssh config
+const defaultSshConfig = "~/.ssh/config"
+
+// Includes nested deeper than this are assumed to be a loop, like ssh does
+const maxSshConfigDepth = 16
+
+// A single option from an ssh config file
+type sshConfigOption struct {
+	keyword string // lower case
+	name    string // as written, for messages
+	args    []string
+	source  string // file:line
+}
+
+// A `Host` section, or the options before the first one
+type sshHostSection struct {
+	patterns []string // nil for `Match` sections, which never match
+	options  []sshConfigOption
+	source   string
+}
+
+// Read an ssh config file, following includes
+func parseSshConfig(path string) ([]*sshHostSection, error) {
+	path, err := homedir.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+	// Options before the first `Host` line apply to every host
+	sections := []*sshHostSection{{patterns: []string{"*"}, source: path}}
+	if err := readSshConfig(path, &sections, 0); err != nil {
+		return nil, err
+	}
+	return sections, nil
+}
+
+// Add the sections and options of a file to sections
+// Options go into the last section, so includes within a `Host` section belong to it until they
+// start a section of their own.
+func readSshConfig(path string, sections *[]*sshHostSection, depth int) error {
+	if depth > maxSshConfigDepth {
+		return fmt.Errorf("Too many nested includes at %s", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		source := fmt.Sprintf("%s:%d", path, lineNo)
+		name, args, err := splitSshConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s: %s", source, err.Error())
+		}
+		keyword := strings.ToLower(name)
+		switch keyword {
+		case "":
+			continue
+		case "host":
+			*sections = append(*sections, &sshHostSection{patterns: args, source: source})
+		case "match":
+			*sections = append(*sections, &sshHostSection{source: source})
+		case "include":
+			for _, arg := range args {
+				matches, err := sshConfigIncludes(arg, filepath.Dir(path))
+				if err != nil {
+					return fmt.Errorf("%s: %s", source, err.Error())
+				}
+				for _, match := range matches {
+					if err := readSshConfig(match, sections, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			current := (*sections)[len(*sections)-1]
+			current.options = append(current.options, sshConfigOption{keyword, name, args, source})
+		}
+	}
+	return scanner.Err()
+}
+
+// The files an `Include` refers to
+// Relative paths are relative to ~/.ssh for the user's config, or else the directory of the
+// including file.
+func sshConfigIncludes(pattern, dir string) ([]string, error) {
+	pattern, err := homedir.Expand(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(pattern) {
+		if sshDir, err := homedir.Expand("~/.ssh"); err == nil && dir != sshDir {
+			if _, err := os.Stat(filepath.Join(sshDir, pattern)); err == nil {
+				dir = sshDir
+			}
+		}
+		pattern = filepath.Join(dir, pattern)
+	}
+	return filepath.Glob(pattern)
+}
+
+// Split a line of an ssh config file into its keyword and arguments
+// Keywords can be separated from their arguments by spaces or "=", and arguments can be quoted.
+func splitSshConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return line, nil, nil
+	}
+	keyword := line[:end]
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+
+	var args []string
+	var arg bytes.Buffer
+	inQuotes, hasArg := false, false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			hasArg = true
+		case (r == ' ' || r == '\t') && !inQuotes:
+			if hasArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				hasArg = false
+			}
+		case r == '#' && !inQuotes && !hasArg:
+			// The rest of the line is a comment
+			return keyword, args, nil
+		default:
+			arg.WriteRune(r)
+			hasArg = true
+		}
+	}
+	if inQuotes {
+		return "", nil, fmt.Errorf("Unterminated quote")
+	}
+	if hasArg {
+		args = append(args, arg.String())
+	}
+	return keyword, args, nil
+}
+
+// Whether a host matches the patterns of a `Host` line
+// Any matching negated pattern ("!host") rules the host out.
+func (s *sshHostSection) matches(host string) bool {
+	host = strings.ToLower(host)
+	matched := false
+	for _, pattern := range s.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.ToLower(strings.TrimPrefix(pattern, "!"))
+		for _, p := range strings.Split(pattern, ",") {
+			if ok, _ := filepath.Match(p, host); ok {
+				if negated {
+					return false
+				}
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+// Whether a `Host` pattern names a single host rather than a set of them
+func isLiteralHostPattern(pattern string) bool {
+	return !strings.ContainsAny(pattern, "*?![]")
+}
+
+// The options ssh would use to connect to a host alias
+type sshHostConfig struct {
+	Alias    string
+	HostName string
+	User     string
+	Port     string
+	Source   string // where the alias is defined
+	forwards []sshConfigOption
+}
+
+// Look up the options for a host alias
+func resolveSshHost(sections []*sshHostSection, alias, source string) sshHostConfig {
+	host := sshHostConfig{Alias: alias, Source: source}
+	seen := make(map[string]bool)
+	for _, section := range sections {
+		if !section.matches(alias) {
+			continue
+		}
+		for _, option := range section.options {
+			switch option.keyword {
+			case "localforward", "remoteforward", "dynamicforward":
+				host.forwards = append(host.forwards, option)
+				continue
+			}
+			if seen[option.keyword] || len(option.args) == 0 {
+				continue
+			}
+			seen[option.keyword] = true
+			switch option.keyword {
+			case "hostname":
+				host.HostName = strings.Replace(option.args[0], "%h", alias, -1)
+			case "user":
+				host.User = option.args[0]
+			case "port":
+				host.Port = option.args[0]
+			}
+		}
+	}
+	if host.HostName == "" {
+		host.HostName = alias
+	}
+	return host
+}
+
+// Every host alias named in an ssh config, in the order they are defined
+func sshConfigHosts(sections []*sshHostSection) []sshHostConfig {
+	var hosts []sshHostConfig
+	seen := make(map[string]bool)
+	for _, section := range sections {
+		for _, pattern := range section.patterns {
+			if !isLiteralHostPattern(pattern) || seen[strings.ToLower(pattern)] {
+				continue
+			}
+			seen[strings.ToLower(pattern)] = true
+			hosts = append(hosts, resolveSshHost(sections, pattern, section.source))
+		}
+	}
+	return hosts
+}
+
+// Split the listening end of a forward into bind address and port, or a socket path
+// e.g. "8080", "127.0.0.1:8080", "[::1]:8080", "*:8080" or "/tmp/app.sock"
+func parseSshListenAddress(spec string) (bind string, port int32, socket string, err error) {
+	if strings.HasPrefix(spec, "/") {
+		return "", 0, spec, nil
+	}
+	portSpec := spec
+	if i := strings.LastIndex(spec, ":"); i >= 0 && !strings.HasSuffix(spec, "]") {
+		bind, portSpec = strings.Trim(spec[:i], "[]"), spec[i+1:]
+	}
+	port, err = parseSshPort(portSpec)
+	return bind, port, "", err
+}
+
+// Split the target of a forward into host and port, or a socket path
+// e.g. "localhost:80", "[::1]:80" or "/var/run/docker.sock"
+func parseSshTargetAddress(spec string) (host string, port int32, socket string, err error) {
+	if strings.HasPrefix(spec, "/") {
+		return "", 0, spec, nil
+	}
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return "", 0, "", fmt.Errorf("Invalid target '%s', expected host:port", spec)
+	}
+	port, err = parseSshPort(spec[i+1:])
+	return strings.Trim(spec[:i], "[]"), port, "", err
+}
+
+func parseSshPort(spec string) (int32, error) {
+	port, err := strconv.Atoi(spec)
+	if err != nil || port < 1 || port > maxPort {
+		return 0, fmt.Errorf("Invalid port '%s'", spec)
+	}
+	return int32(port), nil
+}
+
+// Turn a forwarding option into a forward for a tunnel of the matching type
+// Warnings are for parts of the option that tunnels can't express, and are left out.
+func sshConfigForward(option sshConfigOption) (kind string, f Forward, warnings []string, err error) {
+	switch option.keyword {
+	case "dynamicforward":
+		if len(option.args) != 1 {
+			return "", f, nil, fmt.Errorf("Expected a single [bind_address:]port")
+		}
+		f.BindAddress, f.LocalPort, f.LocalSocket, err = parseSshListenAddress(option.args[0])
+		return TunnelTypeDynamic, f, nil, err
+
+	case "localforward":
+		if len(option.args) != 2 {
+			return "", f, nil, fmt.Errorf("Expected [bind_address:]port and host:hostport")
+		}
+		if f.BindAddress, f.LocalPort, f.LocalSocket, err = parseSshListenAddress(option.args[0]); err != nil {
+			return "", f, nil, err
+		}
+		if f.RemoteHost, f.RemotePort, f.RemoteSocket, err = parseSshTargetAddress(option.args[1]); err != nil {
+			return "", f, nil, err
+		}
+		if f.RemoteHost == "localhost" {
+			f.RemoteHost = ""
+		}
+		return TunnelTypeLocal, f, nil, nil
+
+	case "remoteforward":
+		// A single argument makes ssh run a SOCKS proxy on the remote side
+		if len(option.args) != 2 {
+			return "", f, nil, fmt.Errorf("Only RemoteForward with a listening port and a target is supported")
+		}
+		var bind string
+		if bind, f.RemotePort, f.RemoteSocket, err = parseSshListenAddress(option.args[0]); err != nil {
+			return "", f, nil, err
+		}
+		if bind != "" {
+			warnings = append(warnings, fmt.Sprintf("%s: remote bind address '%s' isn't supported, the remote host's default is used", option.source, bind))
+		}
+		// The bind address of remote tunnels is where connections are sent to locally
+		if f.BindAddress, f.LocalPort, f.LocalSocket, err = parseSshTargetAddress(option.args[1]); err != nil {
+			return "", f, nil, err
+		}
+		if f.BindAddress == "localhost" {
+			f.BindAddress = ""
+		}
+		return TunnelTypeRemote, f, warnings, nil
+	}
+	return "", f, nil, fmt.Errorf("Unknown forwarding option '%s'", option.keyword)
+}
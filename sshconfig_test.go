@@ -0,0 +1,124 @@
+package tnnlr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitSshConfigLine(t *testing.T) {
+	cases := []struct {
+		line    string
+		keyword string
+		args    []string
+		err     bool
+	}{
+		{"", "", nil, false},
+		{"  # a comment", "", nil, false},
+		{"Host web db", "Host", []string{"web", "db"}, false},
+		{"\tHostName=example.com", "HostName", []string{"example.com"}, false},
+		{"Port = 2222", "Port", []string{"2222"}, false},
+		{`IdentityFile "~/.ssh/work key"`, "IdentityFile", []string{"~/.ssh/work key"}, false},
+		{`LocalForward 8080 "localhost:80" # web`, "LocalForward", []string{"8080", "localhost:80"}, false},
+		{`User ""`, "User", []string{""}, false},
+		{`Host a#b`, "Host", []string{"a#b"}, false},
+		{"Compression", "Compression", nil, false},
+		{`IdentityFile "~/.ssh/work key`, "", nil, true},
+	}
+	for _, c := range cases {
+		keyword, args, err := splitSshConfigLine(c.line)
+		if keyword != c.keyword || !reflect.DeepEqual(args, c.args) || (err != nil) != c.err {
+			t.Errorf("Splitting %q gives %q %q and error %v, expected %q %q and error %v", c.line, keyword, args, err, c.keyword, c.args, c.err)
+		}
+	}
+}
+
+func TestParseSshConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tnnlr-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config": `User everyone
+Include tnnlr-test.d/*.conf
+
+Host web "db backup"
+    HostName %h.example.com
+    LocalForward 8080 localhost:80
+
+Match host web
+    User matched
+    LocalForward 9000 localhost:9000
+
+Host *
+    User fallback
+    Port 2222
+`,
+		"tnnlr-test.d/1-web.conf": `Host web
+    User = "web user"
+    Port 22
+`,
+		"tnnlr-test.d/2-db.conf": `Host db
+    HostName db.internal
+    DynamicForward 1080
+Include loop.conf
+`,
+		"tnnlr-test.d/loop.conf": "",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sections, err := parseSshConfig(filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatalf("Failed to parse ssh config: %s", err)
+	}
+	cases := []struct {
+		alias    string
+		hostName string
+		user     string
+		port     string
+		forwards int
+	}{
+		// Options before the first `Host` apply everywhere, and come first
+		{"web", "web.example.com", "everyone", "22", 1},
+		{"db", "db.internal", "everyone", "2222", 1},
+		{"db backup", "db backup.example.com", "everyone", "2222", 1},
+	}
+	hosts := sshConfigHosts(sections)
+	if len(hosts) != len(cases) {
+		t.Fatalf("Found hosts %+v, expected %d", hosts, len(cases))
+	}
+	for i, c := range cases {
+		host := hosts[i]
+		if host.Alias != c.alias || host.HostName != c.hostName || host.User != c.user || host.Port != c.port || len(host.forwards) != c.forwards {
+			t.Errorf("Host %d is %+v, expected alias %q, host name %q, user %q, port %q and %d forwards",
+				i, host, c.alias, c.hostName, c.user, c.port, c.forwards)
+		}
+	}
+
+	// Quoted values are kept whole, once nothing before them sets the option
+	web := resolveSshHost(sections[1:], "web", "")
+	if web.User != "web user" {
+		t.Errorf("User for web without the global options is %q, expected %q", web.User, "web user")
+	}
+
+	// Includes that include themselves fail instead of recursing forever
+	loop := filepath.Join(dir, "tnnlr-test.d", "loop.conf")
+	if err := ioutil.WriteFile(loop, []byte("Include "+loop+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSshConfig(filepath.Join(dir, "config")); err == nil {
+		t.Error("Expected an error for an include loop")
+	}
+}
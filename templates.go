@@ -50,32 +50,52 @@ var homePage string = `
         {{ end }}
     {{ end }}
 
-    <h2>Existing tunnels</h2>
+    {{ range $profile := $.Profiles }}
+    <h2>{{ if eq $profile.Name "default" }}Existing tunnels{{ else }}Profile: {{ $profile.Name }}{{ end }} ({{ $profile.File }})</h2>
+    {{ with $profile.SourceStatus }}<p class="msg">{{ . }}</p>{{ end }}
     <table>
         <tr>
             <th>ID</th>
             <th>Name</th>
+            <th>Type</th>
             <th>Host</th>
-            <th>Local Port</th>
-            <th>Remote Port</th>
+            <th>Jump Hosts</th>
+            <th>Backend</th>
+            <th>Bind Address</th>
+            <th>Local Port / Socket</th>
+            <th>Remote Host</th>
+            <th>Remote Port / Socket</th>
             <th>Default URL</th>
             <th>Bash Command</th>
             <th>Logs</th>
-            <th>Is Alive?</th>
+            <th>Status</th>
+            <th>Restarts</th>
+            <th>Stop / Start</th>
+            <th>Edit</th>
             <th>Remove</th>
             <th>Reload</th>
+            <th>Export</th>
         </tr>
-    {{range $tunnelId, $tunnel := $.Tunnels }}
+    {{range $tunnelId, $tunnel := $profile.Tunnels }}
         <tr>
             <td>{{ $tunnelId }}</td>
             <td>{{ $tunnel.Name }}</td>
+            <td>{{ $tunnel.Kind }}</td>
             <td>{{ $tunnel.Host }}</td>
-            <td>{{ $tunnel.LocalPort }}</td>
-            <td>{{ $tunnel.RemotePort }}</td>
+            <td>{{ range $jumpHost := $tunnel.JumpHosts }}<div>{{ $jumpHost }}</div>{{ end }}</td>
+            <td>{{ if $tunnel.Backend }}{{ $tunnel.Backend }}{{ else }}{{ $.Backend }}{{ end }}</td>
+            <td>{{ range $fwd := $tunnel.AllForwards }}<div>{{ $fwd.BindAddress }}</div>{{ end }}</td>
+            <td>{{ range $fwd := $tunnel.AllForwards }}<div>{{ $fwd.LocalEnd }}</div>{{ end }}</td>
+            <td>{{ range $fwd := $tunnel.AllForwards }}<div>{{ if and (eq $tunnel.Kind "local") (not $fwd.RemoteSocket) }}{{ $fwd.TargetHost }}{{ end }}</div>{{ end }}</td>
+            <td>{{ range $fwd := $tunnel.AllForwards }}<div>{{ if not $tunnel.IsDynamic }}{{ $fwd.RemoteEnd }}{{ end }}</div>{{ end }}</td>
             <td>
-                <a href="http://localhost:{{ $tunnel.LocalPort }}{{ $tunnel.DefaultUrl }}" target="_blank">
-                    http://localhost:{{ $tunnel.LocalPort }}{{ $tunnel.DefaultUrl }}
-                </a>
+                {{ if $tunnel.IsDynamic }}
+                SOCKS proxy for: {{ range $pattern := $tunnel.ProxyPatterns }}{{ $pattern }} {{ end }}
+                {{ else }}
+                {{ range $fwd := $tunnel.AllForwards }}
+                <div>{{ if and $fwd.DefaultUrl (not $fwd.LocalSocket) }}<a href="{{ $fwd.URLFor $.Hostname }}" target="_blank">{{ $fwd.URLFor $.Hostname }}</a>{{ end }}</div>
+                {{ end }}
+                {{ end }}
             </td>
             <td>
                 <a href="bash_command/{{ $tunnelId }}/" target="_blank">Show command</a>
@@ -83,52 +103,63 @@ var homePage string = `
             <td>
                 <a href="logs/{{ $tunnelId }}/" target="_blank">Show logs</a>
             </td>
-            <td>{{ $tunnel.IsAlive }}</td>
+            <td>{{ $tunnel.Status }}{{ with $tunnel.ConnectionState }} ({{ . }}){{ end }}</td>
+            <td>{{ $tunnel.RestartInfo }}</td>
+            <td>{{ if eq $tunnel.Status "stopped" }}<a href="start/{{ $tunnelId }}/">Start</a>{{ else }}<a href="stop/{{ $tunnelId }}/">Stop</a>{{ end }}</td>
+            <td><a href="edit/{{ $tunnelId }}/">Edit</a></td>
             <td><a href="remove/{{ $tunnelId }}/">Remove</a></td>
             <td><a href="reload/{{ $tunnelId }}/">Reload</a></td>
+            <td><input type="checkbox" name="id" value="{{ $tunnelId }}" form="export-{{ $profile.Name }}"></td>
         </tr>
     {{ end }}
     </table>
 
-    <form action="/save/" method="post">
+    <form action="/save/?profile={{ $profile.Name }}" method="post">
         <input type="submit" value="Save Tunnels to File">
     </form>
-    <form action="/reload/" method="post">
+    <form action="/reload/?profile={{ $profile.Name }}" method="post">
         <input type="submit" value="Reload Tunnels from File">
     </form>
+    <form action="/reload_plan" method="get">
+        <input type="hidden" name="profile" value="{{ $profile.Name }}">
+        <input type="submit" value="Preview Reload">
+    </form>
+    <form action="/stop/?profile={{ $profile.Name }}" method="post">
+        <input type="submit" value="Stop All">
+    </form>
+    <form action="/import_ssh_config" method="get">
+        <input type="hidden" name="profile" value="{{ $profile.Name }}">
+        <input type="submit" value="Import from ssh config">
+    </form>
+    <form id="export-{{ $profile.Name }}" action="/export" method="get">
+        <input type="hidden" name="profile" value="{{ $profile.Name }}">
+        <select name="format">
+            {{ range $format := $.ExportFormats }}<option value="{{ $format }}">{{ $format }}</option>{{ end }}
+        </select>
+        <input type="submit" value="Export">
+    </form>
+    {{ end }}
+
+    <form action="/proxy.pac" method="get">
+        <input type="submit" value="Proxy Auto-Config File">
+    </form>
 
     <h2>Add new tunnel</h2>
     <form class="new_tunnel" action="/add/" method="post">
         <table>
         <tr>
-            <td>Tunnel Name</td>
-            <td><input type="text" name="name"></td>
-        </tr>
-        <tr>
-            <td>Host</td>
-            <td><input type="text" name="host"></td>
-        </tr>
-        <tr>
-            <td>SSH Username</td>
-            <td><input type="text" name="username"></td>
-        </tr>
-        <tr>
-            <td>Local Port</td>
-            <td><input type="text" name="localPort"></td>
-        </tr>
-        <tr>
-            <td>Remote Port</td>
-            <td><input type="text" name="remotePort"></td>
-        </tr>
-        <tr>
-            <td>Default URL</td>
-            <td><input type="text" name="defaultUrl"></td>
+            <td>Profile</td>
+            <td>
+                <select name="profile">
+                    {{ range $profile := $.Profiles }}<option value="{{ $profile.Name }}">{{ $profile.Name }}</option>{{ end }}
+                </select>
+            </td>
         </tr>
+        {{ template "TunnelFields" $.NewTunnel }}
         <tr>
             <td colspan="2" class="submit"><input type="submit" value="Submit"></td>
         </tr>
         </table>
-        
     </form>
 
     <div id="tips">
@@ -136,12 +167,42 @@ var homePage string = `
         <h2>Tips</h2>
         <ul>
             <li>
-            The process may be marked "not alive" because of a network timeout.  Try reloading this page to check status again.
+            A tunnel is "starting" while its process is running but its forwards aren't accepting connections yet, and "dead" once the process has exited.  Dead tunnels are restarted according to their restart policy, waiting longer after each restart in a row.  Tunnels that keep dying are marked "crash-looping" and left down until reloaded.
             </li>
             <li>
             Running "reload" both re-loads the definition of a process disk and restarts that process.  Be sure to save any edited process state to disk before reloading.
             </li>
             <li>
+            "Edit" changes a tunnel in place, keeping its id.  The tunnel is only restarted if something about its connection changed, so renaming it or changing its default URL doesn't drop connections through it.  Save to keep the change in the tunnels file.
+            </li>
+            <li>
+            "Reload Tunnels from File" only starts, stops or updates tunnels that were added, removed or changed in the file, so connections through the others stay up.  Like "Edit", changed tunnels are only restarted if something about their connection changed.  Use "Preview Reload" to see what it would do first.
+            </li>
+            <li>
+            "remote" tunnels expose the local port on the remote host (like "ssh -R").  Since the local port belongs to the service being exposed, these are marked up as long as the ssh process is running.
+            </li>
+            <li>
+            A tunnel can carry several forwards over a single ssh connection.  Add them to the "forwards" list of the tunnel in your tunnels file.
+            </li>
+            <li>
+            "dynamic" tunnels run a SOCKS proxy on the local port (like "ssh -D").  Set your browser's automatic proxy configuration URL to "http://localhost:{{ $.Port }}/proxy.pac" to send hosts matching each tunnel's proxy patterns (e.g. "*.internal" or "10.0.0.0/16") through it.
+            </li>
+            <li>
+            Set the "Bind Address" to "0.0.0.0" (or "::" for IPv6) to make a tunnel reachable from other machines, e.g. when running tnnlr in a headless VM.
+            </li>
+            <li>
+            The "native" backend connects from inside tnnlr instead of running ssh.  It doesn't read your ssh config, so use full host names (with ":port" if needed), and it checks host keys against "~/.ssh/known_hosts".
+            </li>
+            <li>
+            The "exec" backend runs the tunnel's command instead of ssh, e.g. "kubectl port-forward svc/grafana {{"{{"}}.LocalPort{{"}}"}}:{{"{{"}}.RemotePort{{"}}"}}".  Fields of the tunnel can be used in the command.
+            </li>
+            <li>
+            "Export" downloads the tunnels checked in the "Export" column, or all of the profile's tunnels if none are checked, to run without tnnlr: as an ssh config snippet, a bash script, or a systemd or launchd service per tunnel.
+            </li>
+            <li>
+            "Import from ssh config" turns the LocalForward, RemoteForward and DynamicForward entries in your ssh config into tunnels.  Imported tunnels connect to the host alias, so the rest of your ssh config still applies to them.
+            </li>
+            <li>
             Leave the "SSH Username" section of the form empty when adding a new tunnel to use the default value specified in your ssh config.
             </li>
         </ul>
@@ -149,3 +210,236 @@ var homePage string = `
 
 </body>
 `
+
+var reloadPlanPage string = `
+<!doctype html>
+<head>
+    <title>Tnnlr - Reload Preview</title>
+    <style>
+        table, tr, td, th {
+            border: 1px solid black;
+            padding: 2px;
+        }
+        form {
+            margin: 10px 0px 10px 0px;
+        }
+    </style>
+</head>
+<body>
+    <h2>Reloading {{ if ne $.Profile "default" }}profile {{ $.Profile }} {{ end }}from {{ $.File }} would</h2>
+    <table>
+        <tr>
+            <th>Action</th>
+            <th>ID</th>
+            <th>Name</th>
+            <th>Changed Fields</th>
+        </tr>
+    {{ range $action := $.Plan }}
+        <tr>
+            <td>{{ $action.Action }}</td>
+            <td>{{ $action.Id }}</td>
+            <td>{{ $action.Name }}</td>
+            <td>{{ range $field := $action.Changes }}<div>{{ $field }}</div>{{ end }}</td>
+        </tr>
+    {{ end }}
+    </table>
+
+    <form action="/reload/?profile={{ $.Profile }}" method="post">
+        <input type="submit" value="Apply">
+    </form>
+    <a href="/">Back</a>
+</body>
+`
+
+var importSshConfigPage string = `
+<!doctype html>
+<head>
+    <title>Tnnlr - Import from ssh config</title>
+    <style>
+        table, tr, td, th {
+            border: 1px solid black;
+            padding: 2px;
+        }
+        form {
+            margin: 10px 0px 10px 0px;
+        }
+    </style>
+</head>
+<body>
+    <h2>Tunnels in {{ $.SshConfig }} to import into {{ if ne $.Profile "default" }}profile {{ $.Profile }}{{ else }}{{ $.File }}{{ end }}</h2>
+    <form action="/import_ssh_config?profile={{ $.Profile }}" method="post">
+        <input type="hidden" name="sshConfig" value="{{ $.SshConfig }}">
+        <table>
+            <tr>
+                <th>Import</th>
+                <th>Name</th>
+                <th>Type</th>
+                <th>Host</th>
+                <th>Resolves To</th>
+                <th>Forwards</th>
+                <th>Defined In</th>
+                <th>Notes</th>
+            </tr>
+        {{ range $imp := $.Imports }}
+            <tr>
+                <td><input type="checkbox" name="tunnel" value="{{ $imp.Tunnel.Name }}"{{ if $imp.Importable }} checked{{ else }} disabled{{ end }}></td>
+                <td>{{ $imp.Tunnel.Name }}</td>
+                <td>{{ $imp.Tunnel.Kind }}</td>
+                <td>{{ $imp.Tunnel.Host }}</td>
+                <td>{{ if $imp.User }}{{ $imp.User }}@{{ end }}{{ $imp.HostName }}{{ if $imp.Port }}:{{ $imp.Port }}{{ end }}</td>
+                <td>{{ range $fwd := $imp.Forwards }}<div>
+                    {{ if $imp.Tunnel.IsDynamic }}{{ $fwd.LocalEnd }} (SOCKS)
+                    {{ else if $imp.Tunnel.IsRemote }}{{ $fwd.RemoteEnd }} &larr; {{ $fwd.LocalEnd }}
+                    {{ else }}{{ $fwd.LocalEnd }} &rarr; {{ if not $fwd.RemoteSocket }}{{ $fwd.TargetHost }}:{{ end }}{{ $fwd.RemoteEnd }}{{ end }}
+                </div>{{ end }}</td>
+                <td>{{ $imp.Source }}</td>
+                <td>
+                    {{ if $imp.Exists }}<div>Already in the profile</div>{{ end }}
+                    {{ range $problem := $imp.Problems }}<div><b>{{ $problem }}</b></div>{{ end }}
+                    {{ range $warning := $imp.Warnings }}<div>{{ $warning }}</div>{{ end }}
+                </td>
+            </tr>
+        {{ else }}
+            <tr><td colspan="8">No forwards found</td></tr>
+        {{ end }}
+        </table>
+        <input type="submit" value="Import Selected">
+    </form>
+    <a href="/">Back</a>
+</body>
+`
+
+var tunnelFields string = `
+        <tr>
+            <td>Tunnel Name</td>
+            <td><input type="text" name="name" value="{{ .Name }}"></td>
+        </tr>
+        <tr>
+            <td>Type</td>
+            <td>
+                <select name="type">
+                    <option value="local"{{ if eq .Kind "local" }} selected{{ end }}>local (-L)</option>
+                    <option value="remote"{{ if eq .Kind "remote" }} selected{{ end }}>remote (-R)</option>
+                    <option value="dynamic"{{ if eq .Kind "dynamic" }} selected{{ end }}>dynamic (-D)</option>
+                </select>
+            </td>
+        </tr>
+        <tr>
+            <td>Host</td>
+            <td><input type="text" name="host" value="{{ .Host }}"></td>
+        </tr>
+        <tr>
+            <td>Identity File (optional)</td>
+            <td><input type="text" name="identityFile" value="{{ .IdentityFile }}"></td>
+        </tr>
+        <tr>
+            <td>Backend</td>
+            <td>
+                <select name="backend">
+                    <option value="">default ({{ .DefaultBackend }})</option>
+                    <option value="ssh"{{ if eq .Backend "ssh" }} selected{{ end }}>ssh</option>
+                    <option value="native"{{ if eq .Backend "native" }} selected{{ end }}>native</option>
+                    <option value="exec"{{ if eq .Backend "exec" }} selected{{ end }}>exec</option>
+                </select>
+            </td>
+        </tr>
+        <tr>
+            <td>Command (exec backend only)</td>
+            <td><input type="text" name="command" value="{{ .Command }}"></td>
+        </tr>
+        <tr>
+            <td>Jump Hosts (comma separated, in order)</td>
+            <td><input type="text" name="jumpHosts" value="{{ range $i, $jumpHost := .JumpHosts }}{{ if $i }}, {{ end }}{{ $jumpHost }}{{ end }}"></td>
+        </tr>
+        <tr>
+            <td>SSH Username</td>
+            <td><input type="text" name="username" value="{{ .Username }}"></td>
+        </tr>
+        <tr>
+            <td>Bind Address (e.g. 127.0.0.1, 0.0.0.0, ::1)</td>
+            <td><input type="text" name="bindAddress" value="{{ .BindAddress }}"></td>
+        </tr>
+        <tr>
+            <td>Local Port</td>
+            <td><input type="text" name="localPort" value="{{ if .LocalPort }}{{ .LocalPort }}{{ end }}"></td>
+        </tr>
+        <tr>
+            <td>Local Socket (instead of local port)</td>
+            <td><input type="text" name="localSocket" value="{{ .LocalSocket }}"></td>
+        </tr>
+        <tr>
+            <td>Remote Host (local only, defaults to localhost on the ssh host)</td>
+            <td><input type="text" name="remoteHost" value="{{ .RemoteHost }}"></td>
+        </tr>
+        <tr>
+            <td>Remote Port</td>
+            <td><input type="text" name="remotePort" value="{{ if .RemotePort }}{{ .RemotePort }}{{ end }}"></td>
+        </tr>
+        <tr>
+            <td>Remote Socket (instead of remote host and port)</td>
+            <td><input type="text" name="remoteSocket" value="{{ .RemoteSocket }}"></td>
+        </tr>
+        <tr>
+            <td>Default URL</td>
+            <td><input type="text" name="defaultUrl" value="{{ .DefaultUrl }}"></td>
+        </tr>
+        <tr>
+            <td>Proxy Patterns (dynamic only, comma separated)</td>
+            <td><input type="text" name="proxyPatterns" value="{{ range $i, $pattern := .ProxyPatterns }}{{ if $i }}, {{ end }}{{ $pattern }}{{ end }}"></td>
+        </tr>
+        <tr>
+            <td>Start when tnnlr starts</td>
+            <td><input type="checkbox" name="autostart" value="true"{{ if .Autostart }} checked{{ end }}></td>
+        </tr>
+        <tr>
+            <td>Restart</td>
+            <td>
+                <select name="restart">
+                    <option value=""{{ if eq .Restart "" }} selected{{ end }}>(default)</option>
+                    <option value="always"{{ if eq .Restart "always" }} selected{{ end }}>always</option>
+                    <option value="on-failure"{{ if eq .Restart "on-failure" }} selected{{ end }}>on-failure</option>
+                    <option value="never"{{ if eq .Restart "never" }} selected{{ end }}>never</option>
+                </select>
+            </td>
+        </tr>
+        <tr>
+            <td>Max Retries (defaults to 5, -1 for no limit)</td>
+            <td><input type="text" name="maxRetries" value="{{ if .MaxRetries }}{{ .MaxRetries }}{{ end }}"></td>
+        </tr>
+        <tr>
+            <td>Restart Backoff in seconds (initial, max)</td>
+            <td><input type="text" name="restartBackoff" size="5" value="{{ if .RestartBackoff }}{{ .RestartBackoff }}{{ end }}"> <input type="text" name="restartBackoffMax" size="5" value="{{ if .RestartBackoffMax }}{{ .RestartBackoffMax }}{{ end }}"></td>
+        </tr>
+`
+
+var editTunnelPage string = `
+<!doctype html>
+<head>
+    <title>Tnnlr - Edit {{ $.Form.Name }}</title>
+    <style>
+        table, tr, td, th {
+            border: 1px solid black;
+            padding: 2px;
+        }
+        form {
+            margin: 10px 0px 10px 0px;
+        }
+    </style>
+</head>
+<body>
+    <h2>Edit tunnel {{ $.Form.Name }}{{ if ne $.Form.Profile "default" }} (profile {{ $.Form.Profile }}){{ end }}</h2>
+    <p>
+    The tunnel keeps its id ({{ $.Form.Id }}).  It is only restarted if something about its connection changes, so changing just its name, default URL, proxy patterns or restart settings doesn't drop connections through it.
+    </p>
+    {{ with $.Form.Forwards }}<p>Additional forwards ({{ len . }}) are kept as they are, edit them in the tunnels file.</p>{{ end }}
+    <form action="/edit/{{ $.Form.Id }}" method="post">
+        <table>
+        {{ template "TunnelFields" $.Form }}
+        <tr>
+            <td colspan="2" class="submit"><input type="submit" value="Save"></td>
+        </tr>
+        </table>
+    </form>
+    <a href="/">Back</a>
+</body>
+`
@@ -1,26 +1,30 @@
 package tnnlr
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
-	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
 	"labix.org/v2/mgo/bson"
 )
 
 // Store messages for the user in between views
 // FIXME: Add fields to improve UI
 type Message struct {
-	msg string
+	msg   string
 	mtime time.Time
 }
 
@@ -32,17 +36,44 @@ func (m *Message) Tstring() string {
 	return m.mtime.Format(time.RFC822)
 }
 
+// How long to wait for web requests to finish on shutdown
+const shutdownTimeout = 5 * time.Second
+
+// How many tunnels to start at once on startup
+const autostartConcurrency = 4
+
+// Returned for ids that don't match any managed tunnel
+type TunnelNotFoundError string
+
+func (e TunnelNotFoundError) Error() string {
+	return fmt.Sprintf("Did not find any tunnel with id: %s", string(e))
+}
 
 // Server
 type Tnnlr struct {
 	sync.Mutex
 	Template         *template.Template
 	SshExec          string // path to ssh executable
+	Backend          string // default backend for tunnels that don't set one
+	Detach           bool   // leave tunnel processes running when tnnlr exits
+	Autostart        bool   // start every tunnel in the tunnels file on startup, not just those marked autostart
+	Watch            bool   // reload the tunnels file when it changes
 	LogLevel         string
 	TunnelReloadFile string
-	Port int
+	Format           string    // format of the tunnels file, detected from the extension if ""
+	Profiles         []Profile // tunnels files to manage alongside TunnelReloadFile, see profile.go
+	SshConfig        string    // ssh config to import tunnels from, defaults to ~/.ssh/config
+	SourceTimeout    int       // seconds to wait for tunnels files that are executables, see source.go
+	SourceRefresh    int       // seconds between runs of tunnels files that are executables, 0 to only run them when reloading
+	Port             int
 	msgs             chan Message
 	tunnels          map[string]*Tunnel
+	busy             map[string]bool // tunnels being started or stopped, see `claim`
+	released         *sync.Cond      // signalled when a tunnel stops being busy
+	shuttingDown     bool            // set by `Shutdown`, after which tunnels can't be claimed
+	backends         map[string]TunnelBackend
+	reloadLock       sync.Mutex // one reload at a time, so plans aren't applied on top of each other
+	profiles         []*Profile // the default profile first
 }
 
 func (t *Tnnlr) Init() {
@@ -50,7 +81,7 @@ func (t *Tnnlr) Init() {
 	var level log.Level
 
 	// Create bookkeeping directories
-	for _, dir := range []string{relProc, relLog} {
+	for _, dir := range []string{relProc, relLog, relInventory} {
 		if err = createRelDir(dir); err != nil {
 			log.WithFields(log.Fields{
 				"err": err,
@@ -64,6 +95,18 @@ func (t *Tnnlr) Init() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if _, err = t.Template.New("ReloadPlan").Parse(reloadPlanPage); err != nil {
+		log.Fatal(err)
+	}
+	if _, err = t.Template.New("ImportSshConfig").Parse(importSshConfigPage); err != nil {
+		log.Fatal(err)
+	}
+	if _, err = t.Template.New("TunnelFields").Parse(tunnelFields); err != nil {
+		log.Fatal(err)
+	}
+	if _, err = t.Template.New("EditTunnel").Parse(editTunnelPage); err != nil {
+		log.Fatal(err)
+	}
 
 	// Set log level
 	level, err = log.ParseLevel(t.LogLevel)
@@ -78,11 +121,65 @@ func (t *Tnnlr) Init() {
 	// A generously buffered channel
 	t.msgs = make(chan Message, 100)
 	t.tunnels = make(map[string]*Tunnel)
+	t.busy = make(map[string]bool)
+	t.released = sync.NewCond(&t.Mutex)
 
-	// FIXME: Pull from config
+	// Defaults for anything not set from the command line
 	// ADD: default username
-	t.TunnelReloadFile = ".tnnlr"
-	t.SshExec = "ssh"
+	if t.TunnelReloadFile == "" {
+		t.TunnelReloadFile = ".tnnlr"
+	}
+	if t.SshExec == "" {
+		t.SshExec = "ssh"
+	}
+	if t.SshConfig == "" {
+		t.SshConfig = defaultSshConfig
+	}
+	if err = validateFormat(t.Format); err != nil {
+		log.WithFields(log.Fields{
+			"format": t.Format,
+		}).Fatal("Invalid value for option 'format'")
+	}
+	if t.SourceTimeout < 0 {
+		log.WithFields(log.Fields{
+			"sourceTimeout": t.SourceTimeout,
+		}).Fatal("Invalid value for option 'source-timeout'")
+	}
+	if t.SourceRefresh < 0 {
+		log.WithFields(log.Fields{
+			"sourceRefresh": t.SourceRefresh,
+		}).Fatal("Invalid value for option 'source-refresh'")
+	}
+	if err = t.initProfiles(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("Invalid value for option 'profiles'")
+	}
+	if t.Backend == "" {
+		t.Backend = BackendSsh
+	}
+	t.backends = map[string]TunnelBackend{
+		BackendSsh:    &sshBackend{Exec: t.SshExec, Detach: t.Detach},
+		BackendNative: &nativeBackend{},
+		BackendExec:   &execBackend{Detach: t.Detach},
+	}
+	// exec needs a command, so it can only be chosen per tunnel
+	if _, ok := t.backends[t.Backend]; !ok || t.Backend == BackendExec {
+		log.WithFields(log.Fields{
+			"backend": t.Backend,
+		}).Fatal("Invalid value for option 'backend'")
+	}
+
+	// Pick up tunnels from an earlier run instead of starting duplicates
+	t.AdoptTunnels()
+}
+
+// The backend to run a tunnel with
+func (t *Tnnlr) backendFor(tnnl *Tunnel) TunnelBackend {
+	if b, ok := t.backends[tnnl.Backend]; ok {
+		return b
+	}
+	return t.backends[t.Backend]
 }
 
 // Add a message to the queue
@@ -92,12 +189,12 @@ func (t *Tnnlr) AddMessage(msg string) {
 	case t.msgs <- Message{msg, time.Now()}:
 		log.WithFields(log.Fields{
 			"nmsgs": len(t.msgs),
-			"msg": msg,
+			"msg":   msg,
 		}).Debug("Added message.")
-	case <-time.After(1*time.Millisecond):
+	case <-time.After(1 * time.Millisecond):
 		log.WithFields(log.Fields{
 			"nmsgs": len(t.msgs),
-			"msg": msg,
+			"msg":   msg,
 		}).Error("Message buffer is full, can't add message. Reload page to drain messages.")
 	}
 }
@@ -105,6 +202,16 @@ func (t *Tnnlr) AddMessage(msg string) {
 func (t *Tnnlr) Run() {
 	// Launch process to clean logs and pid files
 	go t.CleanBookkeepingDirs()
+	// And to restart tunnels that die
+	go t.SuperviseTunnels()
+	// Start tunnels in the background so the web UI is available right away
+	go t.AutostartTunnels()
+	for _, p := range t.profiles {
+		if t.Watch {
+			go t.WatchTunnelsFile(p)
+		}
+		go t.RefreshSource(p)
+	}
 
 	if log.GetLevel() != log.DebugLevel {
 		gin.SetMode(gin.ReleaseMode)
@@ -114,12 +221,109 @@ func (t *Tnnlr) Run() {
 	r.POST("/save", t.Save)
 	r.POST("/add", t.Add)
 	r.GET("/remove/:id", t.Remove)
+	r.GET("/edit/:id", t.EditView)
+	r.POST("/edit/:id", t.Edit)
+	r.GET("/stop/:id", t.StopOne)
+	r.GET("/start/:id", t.StartOne)
 	r.POST("/reload", t.Reload)
+	r.POST("/stop", t.StopAll)
+	r.GET("/reload_plan", t.ReloadPlan)
+	r.GET("/validate", t.ValidateFile)
+	r.GET("/import_ssh_config", t.ImportSshConfigPreview)
+	r.POST("/import_ssh_config", t.ImportSshConfig)
 	r.GET("/reload/:id", t.ReloadOne)
 	r.GET("/bash_command/:id", t.ShowCommand)
+	r.GET("/export", t.Export)
 	r.GET("/logs/:id", t.ShowLogs)
 	r.GET("/status/:id", t.ReloadOne)
-	r.Run(fmt.Sprintf(":%d", t.Port))
+	r.GET("/proxy.pac", t.ProxyAutoConfig)
+	t.apiRoutes(r.Group("/api/v1"))
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", t.Port),
+		Handler: r,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"port": t.Port,
+			}).Fatal("Unable to run web server")
+		}
+	}()
+
+	t.handleSignals(srv)
+}
+
+// Block until tnnlr is asked to exit
+// SIGHUP reloads the tunnels file, and SIGINT or SIGTERM shut down.
+func (t *Tnnlr) handleSignals(srv *http.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			log.Info("Reloading tunnels files")
+			for _, p := range t.profiles {
+				if _, err := t.ReloadTunnels(p); err != nil {
+					t.reportLoadError(p, "Failed to parse tunnels from file", err)
+				}
+			}
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"signal": sig.String(),
+		}).Warn("Shutting down")
+		t.Shutdown(srv)
+		return
+	}
+}
+
+// Stop serving the web UI, then stop tunnels
+// With `Detach` set, tunnels with their own process are left running for the next tnnlr to adopt.
+func (t *Tnnlr) Shutdown(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Failed to stop web server cleanly")
+	}
+
+	// Let starts and stops in progress finish, so their processes are stopped below
+	t.Lock()
+	defer t.Unlock()
+	t.shuttingDown = true
+	for len(t.busy) > 0 {
+		t.released.Wait()
+	}
+
+	// Hold the lock throughout so nothing is restarted, and stop tunnels in parallel
+	var wg sync.WaitGroup
+	for tnnlId, tnnl := range t.tunnels {
+		if _, isNative := tnnl.backend.(*nativeBackend); t.Detach && !isNative {
+			log.WithFields(log.Fields{
+				"id":   tnnl.Id,
+				"name": tnnl.Name,
+				"pid":  tnnl.Pid,
+			}).Info("Leaving tunnel running")
+			continue
+		}
+		t.busy[tnnlId] = true
+		wg.Add(1)
+		go func(tnnl *Tunnel) {
+			defer wg.Done()
+			if err := tnnl.Stop(); err != nil {
+				log.WithFields(log.Fields{
+					"err":  err,
+					"id":   tnnl.Id,
+					"name": tnnl.Name,
+				}).Error("Failed to stop tunnel")
+			}
+		}(tnnl)
+		delete(t.tunnels, tnnlId)
+	}
+	wg.Wait()
 }
 
 // HTTP views
@@ -136,14 +340,33 @@ messageLoop:
 		}
 	}
 
+	type profileView struct {
+		*Profile
+		Tunnels map[string]*Tunnel
+	}
+	var profiles []profileView
+	for _, p := range t.profiles {
+		profiles = append(profiles, profileView{p, t.ProfileTunnels(p.Name)})
+	}
+
 	data := struct {
-		HasMessages bool
-		Messages    []Message
-		Tunnels     map[string]*Tunnel
+		HasMessages   bool
+		Messages      []Message
+		Profiles      []profileView
+		Port          int
+		Hostname      string
+		Backend       string
+		ExportFormats []string
+		NewTunnel     tunnelForm
 	}{
 		len(messages) > 0,
 		messages,
-		t.tunnels,
+		profiles,
+		t.Port,
+		requestHostname(c.Request),
+		t.Backend,
+		ExportFormats,
+		tunnelForm{&Tunnel{}, t.Backend},
 	}
 
 	if err := t.Template.Execute(c.Writer, data); err != nil {
@@ -153,76 +376,187 @@ messageLoop:
 	}
 }
 
+// The hostname the web UI was reached on, without the port
+func requestHostname(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return r.Host
+	}
+	return host
+}
+
 // Reload from config file
+// Only new, changed and removed tunnels are started or stopped
 func (t *Tnnlr) Reload(c *gin.Context) {
-	log.Warn("Killing all active tunnels before loading")
-	t.KillAllTunnels()
+	p, err := t.requestProfile(c)
+	if err != nil {
+		t.AddMessage(err.Error())
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	if _, err := t.ReloadTunnels(p); err != nil {
+		t.reportLoadError(p, "Failed to parse tunnels from file", err)
+	}
+	c.Redirect(http.StatusFound, "/")
+}
 
-	tmpTunnels, err := t.Load()
+// Show what reloading from the config file would do, without doing it
+// Responds with json when called with `?format=json`
+func (t *Tnnlr) ReloadPlan(c *gin.Context) {
+	p, err := t.requestProfile(c)
 	if err != nil {
-		message := "Failed to parse tunnels from file"
-		log.WithFields(log.Fields{
-			"err":  err.Error(),
-			"file": t.TunnelReloadFile,
-		}).Error(message)
-		t.AddMessage(message)
+		if c.Query("format") == "json" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		t.AddMessage(err.Error())
 		c.Redirect(http.StatusFound, "/")
 		return
 	}
 
-	// Add 1 at a time
-	nTunnelsLoaded := 0
-	for _, tnnl := range tmpTunnels {
-		if err = t.AddTunnel(tnnl); err != nil {
-			message := fmt.Sprintf("Failed to add tunnel '%s' from file", tnnl.Id)
+	tmpTunnels, err := p.Load()
+	if err != nil {
+		message := "Failed to parse tunnels from file"
+		if c.Query("format") == "json" {
 			log.WithFields(log.Fields{
 				"err":  err.Error(),
-				"file": t.TunnelReloadFile,
+				"file": p.File,
 			}).Error(message)
-			t.AddMessage(message)
-		} else {
-			nTunnelsLoaded++
+			if errs, ok := err.(ValidationErrors); ok {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": message, "errors": errs})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: %s", message, err.Error())})
+			return
 		}
+		t.reportLoadError(p, message, err)
+		c.Redirect(http.StatusFound, "/")
+		return
 	}
 
-	t.AddMessage(fmt.Sprintf("Finished loading %d of %d tunnels from file: %s", nTunnelsLoaded, len(tmpTunnels), t.TunnelReloadFile))
-	c.Redirect(http.StatusFound, "/")
+	plan := t.PlanReconcile(p, tmpTunnels)
+	if c.Query("format") == "json" {
+		c.JSON(http.StatusOK, plan)
+		return
+	}
+
+	data := struct {
+		Profile string
+		File    string
+		Plan    []ReconcileAction
+	}{
+		p.Name,
+		p.File,
+		plan,
+	}
+	if err := t.Template.ExecuteTemplate(c.Writer, "ReloadPlan", data); err != nil {
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+		}).Error("Error executing template")
+	}
 }
 
-// Save set of tunnels to a file
+// Save a profile's tunnels to its file
 func (t *Tnnlr) Save(c *gin.Context) {
-	f, err := os.Create(t.TunnelReloadFile)
+	p, err := t.requestProfile(c)
 	if err != nil {
-		message := "Failed to open tunnel file"
+		t.AddMessage(err.Error())
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	if err := t.SaveProfile(p); err != nil {
+		message := "Failed to write tunnel file"
 		log.WithFields(log.Fields{
 			"err":  err.Error(),
-			"file": t.TunnelReloadFile,
+			"file": p.File,
 		}).Error(message)
-		t.AddMessage(message)
+		t.AddMessage(fmt.Sprintf("%s: %s", message, err.Error()))
 		c.Redirect(http.StatusFound, "/")
 		return
 	}
 
-	var tmpTunnels []*Tunnel
-	for _, tnnl := range t.tunnels {
-		tmpTunnels = append(tmpTunnels, tnnl)
+	t.AddMessage(fmt.Sprintf("Successfully saved tunnels to file: %s", p.File))
+	c.Redirect(http.StatusFound, "/")
+}
+
+// A tunnel to fill in the add and edit forms with
+type tunnelForm struct {
+	*Tunnel
+	DefaultBackend string
+}
+
+// Show a form to edit a tunnel, filled in with its current definition
+func (t *Tnnlr) EditView(c *gin.Context) {
+	tnnl, err := t.Tunnel(c.Param("id"))
+	if err != nil {
+		t.AddMessage(err.Error())
+		c.Redirect(http.StatusFound, "/")
+		return
 	}
 
-	encoder := json.NewEncoder(f)
-	encoder.SetIndent("", "  ")
-	err = encoder.Encode(tmpTunnels)
+	data := struct {
+		Form tunnelForm
+	}{
+		tunnelForm{tnnl, t.Backend},
+	}
+	if err := t.Template.ExecuteTemplate(c.Writer, "EditTunnel", data); err != nil {
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+		}).Error("Error executing template")
+	}
+}
+
+// Change a tunnel in place
+// Accepts html form or json, like `Add`. Forwards aren't part of the form, so they are kept.
+func (t *Tnnlr) Edit(c *gin.Context) {
+	tnnlId := c.Param("id")
+	current, err := t.Tunnel(tnnlId)
 	if err != nil {
-		message := "Failed to write json to file"
+		t.AddMessage(err.Error())
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	var edited Tunnel
+	if err := c.Bind(&edited); err != nil {
+		message := "Invalid form submission"
 		log.WithFields(log.Fields{
-			"err":  err.Error(),
-			"file": t.TunnelReloadFile,
+			"err": err.Error(),
 		}).Error(message)
 		t.AddMessage(message)
 		c.Redirect(http.StatusFound, "/")
 		return
 	}
+	edited.splitFormLists()
+	if edited.Forwards == nil {
+		edited.Forwards = current.Forwards
+	}
+
+	tnnl, restarted, err := t.UpdateTunnel(tnnlId, edited)
+	if err != nil {
+		message := fmt.Sprintf("Unable to update tunnel: %s", current.Name)
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+			"id":  tnnlId,
+		}).Error(message)
+		t.AddMessage(message)
+		if errs, ok := err.(ValidationErrors); ok {
+			for _, e := range errs {
+				t.AddMessage(e.Error())
+			}
+		} else {
+			t.AddMessage(err.Error())
+		}
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
 
-	t.AddMessage(fmt.Sprintf("Successfully saved tunnels to file: %s", t.TunnelReloadFile))
+	if restarted {
+		t.AddMessage(fmt.Sprintf("Updated tunnel '%s' and restarted it", tnnl.Name))
+	} else {
+		t.AddMessage(fmt.Sprintf("Updated tunnel '%s' without restarting it", tnnl.Name))
+	}
 	c.Redirect(http.StatusFound, "/")
 }
 
@@ -230,23 +564,53 @@ func (t *Tnnlr) Save(c *gin.Context) {
 func (t *Tnnlr) Remove(c *gin.Context) {
 	tnnlId := c.Param("id")
 
-	// Error are handled in this function itself
-	t.RemoveTunnel(tnnlId)
+	// Errors stopping the process are reported by RemoveTunnel itself
+	if err := t.RemoveTunnel(tnnlId); err != nil {
+		if _, ok := err.(TunnelNotFoundError); ok {
+			t.AddMessage(err.Error())
+		}
+	}
+	c.Redirect(http.StatusFound, "/")
+}
+
+// Stop a single tunnel without removing it
+func (t *Tnnlr) StopOne(c *gin.Context) {
+	if err := t.StopTunnel(c.Param("id")); err != nil {
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+			"id":  c.Param("id"),
+		}).Error("Failed to stop tunnel")
+		t.AddMessage(fmt.Sprintf("Failed to stop tunnel: %s", err.Error()))
+	}
+	c.Redirect(http.StatusFound, "/")
+}
+
+// Start a single stopped or dead tunnel
+func (t *Tnnlr) StartOne(c *gin.Context) {
+	if err := t.StartTunnel(c.Param("id")); err != nil {
+		t.AddMessage(fmt.Sprintf("Failed to start tunnel: %s", err.Error()))
+	}
 	c.Redirect(http.StatusFound, "/")
 }
 
 // Reload a single tunnel from disk
+// Running tunnels are reloaded from the file of their profile.
 func (t *Tnnlr) ReloadOne(c *gin.Context) {
 	rTnnlId := c.Param("id")
 
-	tmpTunnels, err := t.Load()
+	p, err := t.requestProfile(c)
+	if tnnl, ok := t.ManagedTunnels()[rTnnlId]; ok {
+		p, err = t.profile(tnnl.Profile())
+	}
 	if err != nil {
-		message := "Failed to parse tunnels from file"
-		log.WithFields(log.Fields{
-			"err":  err.Error(),
-			"file": t.TunnelReloadFile,
-		}).Error(message)
-		t.AddMessage(message)
+		t.AddMessage(err.Error())
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	tmpTunnels, err := p.Load()
+	if err != nil {
+		t.reportLoadError(p, "Failed to parse tunnels from file", err)
 		c.Redirect(http.StatusFound, "/")
 		return
 	}
@@ -262,7 +626,7 @@ func (t *Tnnlr) ReloadOne(c *gin.Context) {
 	if foundTnnl.Id == "" {
 		message := "Failed to find tunnel with the requested id"
 		log.WithFields(log.Fields{
-			"file": t.TunnelReloadFile,
+			"file": p.File,
 		}).Error(message)
 		t.AddMessage(message)
 		c.Redirect(http.StatusFound, "/")
@@ -294,14 +658,28 @@ func (t *Tnnlr) Add(c *gin.Context) {
 		return
 	}
 
+	p, err := t.requestProfile(c)
+	if err != nil {
+		t.AddMessage(err.Error())
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	newTunnel.profile = p.Name
+
 	// Ids are bson by default
+	newTunnel.splitFormLists()
 	err = t.AddTunnel(newTunnel)
 	if err != nil {
-		message := fmt.Sprintf("Unable to add tunnel: %s", newTunnel.Id)
+		message := fmt.Sprintf("Unable to add tunnel: %s", newTunnel.Name)
 		log.WithFields(log.Fields{
 			"err": err.Error(),
 		}).Error(message)
 		t.AddMessage(message)
+		if errs, ok := err.(ValidationErrors); ok {
+			for _, e := range errs {
+				t.AddMessage(e.Error())
+			}
+		}
 		c.Redirect(http.StatusFound, "/")
 		return
 	}
@@ -314,12 +692,11 @@ func (t *Tnnlr) ShowCommand(c *gin.Context) {
 	rTnnlId := c.Param("id")
 
 	log.WithFields(log.Fields{
-		"id":      rTnnlId,
-		"tunnels": t.tunnels,
+		"id": rTnnlId,
 	}).Info("Showing command for tunnel")
 
-	tnnl, ok := t.tunnels[rTnnlId]
-	if !ok {
+	tnnl, err := t.Tunnel(rTnnlId)
+	if err != nil {
 		message := "Failed to find tunnel with the requested id"
 		log.WithFields(log.Fields{
 			"file": t.TunnelReloadFile,
@@ -329,19 +706,19 @@ func (t *Tnnlr) ShowCommand(c *gin.Context) {
 		return
 	}
 
-	c.String(200, tnnl.getCommand())
+	files, _ := ExportTunnels([]*Tunnel{tnnl}, ExportCommand, t.SshExec)
+	c.String(200, string(files[0].Content))
 }
 
 func (t *Tnnlr) ShowLogs(c *gin.Context) {
 	rTnnlId := c.Param("id")
 
 	log.WithFields(log.Fields{
-		"id":      rTnnlId,
-		"tunnels": t.tunnels,
+		"id": rTnnlId,
 	}).Info("Showing logs for tunnel")
 
-	tnnl, ok := t.tunnels[rTnnlId]
-	if !ok {
+	tnnl, err := t.Tunnel(rTnnlId)
+	if err != nil {
 		message := "Failed to find tunnel with the requested id"
 		log.WithFields(log.Fields{
 			"file": t.TunnelReloadFile,
@@ -351,7 +728,7 @@ func (t *Tnnlr) ShowLogs(c *gin.Context) {
 		return
 	}
 
-	logfilePath, err := tnnl.LogPath()
+	logfilePath, err := t.backendFor(tnnl).LogPath(tnnl)
 	if err != nil {
 		message := "Failed to find logfile for tunnel with the requested id"
 		log.WithFields(log.Fields{
@@ -364,25 +741,109 @@ func (t *Tnnlr) ShowLogs(c *gin.Context) {
 	c.File(logfilePath)
 }
 
-// Load from disk
-func (t *Tnnlr) Load() ([]Tunnel, error) {
-	var tmpTunnels []Tunnel
+// Serve a proxy auto-config file sending traffic through dynamic tunnels
+// Point your browser's "automatic proxy configuration URL" setting here
+func (t *Tnnlr) ProxyAutoConfig(c *gin.Context) {
+	var tmpTunnels []*Tunnel
+	t.Lock()
+	for _, tnnl := range t.tunnels {
+		tmpTunnels = append(tmpTunnels, tnnl)
+	}
+	t.Unlock()
+
+	c.Data(http.StatusOK, "application/x-ns-proxy-autoconfig", []byte(generatePAC(tmpTunnels)))
+}
 
-	// Load from file
-	raw, err := ioutil.ReadFile(t.TunnelReloadFile)
+// Bring the managed tunnels of a profile in line with its tunnels file, returning what was done
+// Tunnels whose definition hasn't changed are left running, see `PlanReconcile`.
+func (t *Tnnlr) ReloadTunnels(p *Profile) ([]ReconcileAction, error) {
+	tmpTunnels, err := p.Load()
 	if err != nil {
-		return tmpTunnels, err
+		return nil, err
+	}
+	t.reloadLock.Lock()
+	defer t.reloadLock.Unlock()
+	plan := t.PlanReconcile(p, tmpTunnels)
+	t.ApplyReconcile(p, plan)
+	return plan, nil
+}
+
+// Start tunnels from the tunnels files that are marked autostart, or all of them with `Autostart` set
+func (t *Tnnlr) AutostartTunnels() {
+	for _, p := range t.profiles {
+		t.autostartProfile(p)
 	}
+}
 
-	// Load all tunnels
-	err = json.Unmarshal(raw, &tmpTunnels)
+// Start tunnels from a profile's tunnels file on startup
+// Tunnels adopted from an earlier tnnlr are already running, and are skipped.
+func (t *Tnnlr) autostartProfile(p *Profile) {
+	tmpTunnels, err := p.Load()
+	if err != nil {
+		// No tunnels file is fine on startup
+		if !os.IsNotExist(err) {
+			t.reportLoadError(p, "Failed to parse tunnels from file", err)
+		}
+		return
+	}
 
-	return tmpTunnels, err
+	managed := t.ProfileTunnels(p.Name)
+	running := make(map[string]bool)
+	for _, tnnl := range managed {
+		running[tnnl.Name] = true
+	}
+	var toStart []Tunnel
+	for _, tnnl := range tmpTunnels {
+		if !t.Autostart && !tnnl.Autostart {
+			continue
+		}
+		if _, ok := managed[tnnl.Id]; ok || (tnnl.Id == "" && running[tnnl.Name]) {
+			continue
+		}
+		toStart = append(toStart, tnnl)
+	}
+	if len(toStart) == 0 {
+		return
+	}
+
+	// Bounded by the number of slots in sem
+	sem := make(chan struct{}, autostartConcurrency)
+	var wg sync.WaitGroup
+	var nStarted int32
+	for _, tnnl := range toStart {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(tnnl Tunnel) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := t.AddTunnel(tnnl); err != nil {
+				message := fmt.Sprintf("Failed to start tunnel '%s': %s", tnnl.Name, err.Error())
+				log.WithFields(log.Fields{
+					"err":  err.Error(),
+					"name": tnnl.Name,
+				}).Error("Failed to autostart tunnel")
+				t.AddMessage(message)
+				return
+			}
+			atomic.AddInt32(&nStarted, 1)
+		}(tnnl)
+	}
+	wg.Wait()
+
+	t.AddMessage(fmt.Sprintf("Started %d of %d tunnels from file: %s", nStarted, len(toStart), p.File))
 }
 
 // Add a single tunnel
 // Threadsafe
+// The tunnel is checked against the other tunnels of its profile, so saving the profile gives a file
+// that loads.
 func (t *Tnnlr) AddTunnel(tnnl Tunnel) error {
+	return t.addTunnel(tnnl, true)
+}
+
+// Add a single tunnel, optionally checking it against the other tunnels of its profile
+// Reloads check the whole file up front, and would otherwise clash with tunnels they are replacing.
+func (t *Tnnlr) addTunnel(tnnl Tunnel, checkProfile bool) error {
 	// Validate
 	if err := tnnl.Validate(); err != nil {
 		return err
@@ -393,16 +854,61 @@ func (t *Tnnlr) AddTunnel(tnnl Tunnel) error {
 		tnnl.Id = bson.NewObjectId().Hex()
 	}
 
-	// Startup
-	if err := tnnl.Run(t.SshExec); err != nil {
+	// Reserve the id while starting, so nothing else can be added with it
+	t.Lock()
+	if err := t.claim(tnnl.Id); err != nil {
+		t.Unlock()
 		return err
 	}
-
-	// Include in map
-	t.Lock()
+	if current, ok := t.tunnels[tnnl.Id]; ok {
+		t.Unlock()
+		t.release(tnnl.Id)
+		return ValidationErrors{{Index: -1, Field: "id", Message: fmt.Sprintf("Id is already used by tunnel '%s'", current.Name)}}
+	}
+	if checkProfile {
+		if err := t.validateInProfile(&tnnl); err != nil {
+			t.Unlock()
+			t.release(tnnl.Id)
+			return err
+		}
+	}
 	t.tunnels[tnnl.Id] = &tnnl
 	t.Unlock()
+	defer t.release(tnnl.Id)
+
+	// Startup
+	if err := tnnl.Run(t.backendFor(&tnnl)); err != nil {
+		t.Lock()
+		delete(t.tunnels, tnnl.Id)
+		t.Unlock()
+		return err
+	}
+	return nil
+}
 
+// Check a tunnel against the other tunnels of its profile, the way they are checked in a tunnels file
+// Must be called with the lock held.
+func (t *Tnnlr) validateInProfile(tnnl *Tunnel) error {
+	var tunnels []Tunnel
+	for _, other := range t.tunnels {
+		if other.Id != tnnl.Id && other.Profile() == tnnl.Profile() {
+			tunnels = append(tunnels, *other)
+		}
+	}
+	// Last, so clashes are reported against it
+	tunnels = append(tunnels, *tnnl)
+	var errs ValidationErrors
+	for _, err := range validateTunnels(tunnels, func(j int) string {
+		return fmt.Sprintf("tunnel '%s'", tunnels[j].Name)
+	}) {
+		if err.Index == len(tunnels)-1 {
+			err.Index = -1
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
@@ -410,49 +916,303 @@ func (t *Tnnlr) AddTunnel(tnnl Tunnel) error {
 // Threadsafe
 // Logs errors stopping the process, but continues
 func (t *Tnnlr) RemoveTunnel(tnnlId string) error {
-	var err error
+	tnnl, err := t.claimTunnel(tnnlId)
+	if err != nil {
+		return err
+	}
+	defer t.release(tnnlId)
+
+	if err = tnnl.Stop(); err != nil {
+		t.AddMessage(fmt.Sprintf("Failed to kill tunnel %s: '%s'", tnnl.Id, tnnl.Name))
+	}
 	t.Lock()
+	delete(t.tunnels, tnnl.Id)
+	t.Unlock()
+	return err
+}
+
+// Mark a tunnel as being started or stopped, waiting for anything else doing so to finish
+// Must be called with the lock held, which is let go while waiting.
+// Tunnels are started and stopped without the lock held, so a slow ssh doesn't hold up everything else.
+// Fails once tnnlr is shutting down, so nothing is started that `Shutdown` won't stop.
+func (t *Tnnlr) claim(tnnlId string) error {
+	for t.busy[tnnlId] {
+		t.released.Wait()
+	}
+	if t.shuttingDown {
+		return errShuttingDown
+	}
+	t.busy[tnnlId] = true
+	return nil
+}
+
+var errShuttingDown = errors.New("tnnlr is shutting down")
+
+// Claim a managed tunnel, returning it
+// Threadsafe
+func (t *Tnnlr) claimTunnel(tnnlId string) (*Tunnel, error) {
+	t.Lock()
+	defer t.Unlock()
+	if err := t.claim(tnnlId); err != nil {
+		return nil, err
+	}
 	tnnl, ok := t.tunnels[tnnlId]
 	if !ok {
-		message := fmt.Sprintf("Did not find any tunnel with id: %s", tnnlId)
-		t.AddMessage(message)
-		return fmt.Errorf(message)
+		delete(t.busy, tnnlId)
+		t.released.Broadcast()
+		return nil, TunnelNotFoundError(tnnlId)
 	}
+	return tnnl, nil
+}
+
+// Let others start or stop a claimed tunnel
+// Threadsafe
+func (t *Tnnlr) release(tnnlId string) {
+	t.Lock()
+	delete(t.busy, tnnlId)
+	t.Unlock()
+	t.released.Broadcast()
+}
 
+// Look up a managed tunnel
+// Threadsafe
+func (t *Tnnlr) Tunnel(tnnlId string) (*Tunnel, error) {
+	t.Lock()
+	defer t.Unlock()
+	tnnl, ok := t.tunnels[tnnlId]
+	if !ok {
+		return nil, TunnelNotFoundError(tnnlId)
+	}
+	return tnnl, nil
+}
+
+// Stop a tunnel's process, but keep managing the tunnel so it can be started again
+// Threadsafe
+func (t *Tnnlr) StopTunnel(tnnlId string) error {
+	tnnl, err := t.claimTunnel(tnnlId)
+	if err != nil {
+		return err
+	}
+	defer t.release(tnnlId)
 	if err = tnnl.Stop(); err != nil {
-		t.AddMessage(fmt.Sprintf("Failed to kill tunnel %s: '%s'", tnnl.Id, tnnl.Name))
+		return err
 	}
-	delete(t.tunnels, tnnl.Id)
+	// Left alone by the supervisor until started again
+	if tnnl.restarts == nil {
+		tnnl.restarts = newRestartState()
+	}
+	tnnl.restarts.Lock()
+	tnnl.restarts.stopped = true
+	tnnl.restarts.Unlock()
+	return nil
+}
+
+// Start a stopped, dead or crash-looping tunnel
+// Threadsafe
+// Tunnels that are already up or starting are left alone.
+func (t *Tnnlr) StartTunnel(tnnlId string) error {
+	tnnl, err := t.claimTunnel(tnnlId)
+	if err != nil {
+		return err
+	}
+	defer t.release(tnnlId)
+	if status := tnnl.Status(); status == StatusUp || status == StatusStarting {
+		return nil
+	}
+	return t.runManaged(tnnl)
+}
+
+// Stop a tunnel's process and start it again
+// Threadsafe
+func (t *Tnnlr) RestartTunnel(tnnlId string) error {
+	tnnl, err := t.claimTunnel(tnnlId)
+	if err != nil {
+		return err
+	}
+	defer t.release(tnnlId)
+	return t.runManaged(tnnl)
+}
+
+// Replace the definition of a tunnel, keeping its id and profile, returning whether it was restarted
+// Threadsafe
+// The tunnel is only restarted if something about its connection changed, so e.g. renaming it or
+// changing its default URL doesn't drop connections through it. Stopped tunnels stay stopped.
+// Like `AddTunnel`, the new definition is checked against the other tunnels of its profile.
+func (t *Tnnlr) UpdateTunnel(tnnlId string, tnnl Tunnel) (*Tunnel, bool, error) {
+	return t.updateTunnel(tnnlId, tnnl, true)
+}
+
+// Replace the definition of a tunnel, optionally checking it against the other tunnels of its profile
+// See `addTunnel` for when it isn't.
+func (t *Tnnlr) updateTunnel(tnnlId string, tnnl Tunnel, checkProfile bool) (*Tunnel, bool, error) {
+	current, err := t.claimTunnel(tnnlId)
+	if err != nil {
+		return nil, false, err
+	}
+	defer t.release(tnnlId)
+	tnnl.Id, tnnl.Pid, tnnl.profile = current.Id, 0, current.profile
+	if err := tnnl.Validate(); err != nil {
+		return nil, false, err
+	}
+
+	// Checked and swapped in under the same lock, so nothing clashing is added in between
+	t.Lock()
+	if checkProfile {
+		if err := t.validateInProfile(&tnnl); err != nil {
+			t.Unlock()
+			return nil, false, err
+		}
+	}
+	restart := !current.isStopped() && connectionChanged(current, &tnnl)
+	if !restart {
+		// Carry the process over to the new definition
+		tnnl.Pid, tnnl.backend, tnnl.restarts = current.Pid, current.backend, current.restarts
+		tnnl.proc, tnnl.native = current.proc, current.native
+	}
+	t.tunnels[tnnlId] = &tnnl
 	t.Unlock()
+
+	if !restart {
+		if tnnl.backend != nil && !tnnl.isStopped() {
+			// So the new definition is picked up if the tunnel is adopted later
+			if err := tnnl.writePidFile(); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+					"id":  tnnl.Id,
+				}).Error("Failed to update pid file of tunnel")
+			}
+		}
+		return &tnnl, false, nil
+	}
+
+	if err := current.Stop(); err != nil {
+		t.Lock()
+		t.tunnels[tnnlId] = current
+		t.Unlock()
+		return nil, false, err
+	}
+	return &tnnl, true, t.runManaged(&tnnl)
+}
+
+// (Re)start the process of a managed tunnel, with its restart counts starting over
+// Must be called with the tunnel claimed.
+// A tunnel that fails to start stays managed, and is restarted following its restart policy.
+func (t *Tnnlr) runManaged(tnnl *Tunnel) error {
+	if tnnl.restarts == nil {
+		tnnl.restarts = newRestartState()
+	} else {
+		tnnl.restarts.reset()
+	}
+	err := tnnl.Run(t.backendFor(tnnl))
+	if err != nil {
+		// Counts as a death on the next check
+		tnnl.restarts.Lock()
+		tnnl.restarts.runErr = err
+		tnnl.restarts.Unlock()
+		log.WithFields(log.Fields{
+			"id":  tnnl.Id,
+			"err": err,
+		}).Error("Failed to start tunnel")
+	}
 	return err
 }
 
 // Kill all active tunnels
 func (t *Tnnlr) KillAllTunnels() {
-	t.Lock()
-	for tnnlId, _ := range t.tunnels {
+	for tnnlId := range t.ManagedTunnels() {
 		t.RemoveTunnel(tnnlId)
 	}
+}
+
+// Manage tunnels left running by an earlier tnnlr, e.g. one run with `--detach`
+// Only pids still running the tunnel's command are adopted, stale pid files are left to `CleanBookkeepingDirs`.
+func (t *Tnnlr) AdoptTunnels() {
+	procDir, err := getRelativePath(relProc)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Unable to check proc dir for running tunnels")
+		return
+	}
+	pidFiles, err := filepath.Glob(fmt.Sprintf("%s/*.pid", procDir))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Error listing files in proc dir")
+		return
+	}
+
+	nAdopted := 0
+	for _, pf := range pidFiles {
+		tnnl, owner, err := readPidFile(pf)
+		if err != nil || ownedByOtherTnnlr(owner) {
+			continue
+		}
+		if t.adoptTunnel(tnnl) {
+			nAdopted++
+		}
+	}
+	if nAdopted > 0 {
+		t.AddMessage(fmt.Sprintf("Adopted %d tunnels left running by an earlier tnnlr", nAdopted))
+	}
+}
+
+func (t *Tnnlr) adoptTunnel(tnnl Tunnel) bool {
+	// Native tunnels don't outlive their tnnlr, so anything still running is an ssh or exec process
+	pid := tnnl.Pid
+	if pid == os.Getpid() || !pidRunning(pid, tnnl.runsCmdline) {
+		return false
+	}
+	tnnl.backend = t.backends[BackendSsh]
+	if tnnl.Backend == BackendExec {
+		tnnl.backend = t.backends[BackendExec]
+	}
+	tnnl.proc = adoptProcess(pid, func() bool {
+		return pidRunning(pid, tnnl.runsCmdline)
+	})
+	tnnl.restarts = newRestartState()
+	if _, err := t.profile(tnnl.profile); err != nil {
+		log.WithFields(log.Fields{
+			"id":      tnnl.Id,
+			"profile": tnnl.profile,
+		}).Warn("Adopted tunnel is from a profile that isn't loaded, adding it to the default profile")
+		tnnl.profile = ""
+	}
+
+	// Take over the pid file
+	if err := tnnl.writePidFile(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"id":  tnnl.Id,
+		}).Error("Failed to update pid file of adopted tunnel")
+	}
+
+	t.Lock()
+	t.tunnels[tnnl.Id] = &tnnl
 	t.Unlock()
+
+	log.WithFields(log.Fields{
+		"id":   tnnl.Id,
+		"name": tnnl.Name,
+		"pid":  pid,
+	}).Info("Adopted running tunnel")
+	return true
 }
 
-func (t *Tnnlr) ManagedTunnels() map[string]bool {
+func (t *Tnnlr) ManagedTunnels() map[string]*Tunnel {
 	t.Lock()
-	var tunnelIds = make(map[string]bool)
-	for tnnlId, _ := range t.tunnels {
-		tunnelIds[tnnlId] = true
+	var tunnels = make(map[string]*Tunnel)
+	for tnnlId, tnnl := range t.tunnels {
+		tunnels[tnnlId] = tnnl
 	}
 	t.Unlock()
-	return tunnelIds
+	return tunnels
 }
 
 /*
 Background cleanup and management of jobs
 
-TODO
-- check cmd and pid information directly to see if process is running instead of checking port
-- option to leave process running when tnnlr shuts down
-
+Managed tunnels are restarted by `SuperviseTunnels`, this only cleans up after other tunnels.
 */
 func (t *Tnnlr) CleanBookkeepingDirs() {
 
@@ -496,47 +1256,46 @@ func (t *Tnnlr) CleanBookkeepingDirs() {
 		}
 
 		for _, pf := range pidFiles {
-			c, e := ioutil.ReadFile(pf)
+			tnnl, owner, e := readPidFile(pf)
 			if e != nil {
 				os.Remove(pf)
+				continue
 			}
-			var tnnl Tunnel
-			err = json.Unmarshal(c, &tnnl)
-			if e != nil {
-				os.Remove(pf)
+
+			// Managed tunnels are left to the supervisor, and those of other tnnlrs to them
+			if _, isManaged := managedProcesses[tnnl.Id]; isManaged {
+				continue
+			}
+			if ownedByOtherTnnlr(owner) {
+				runningProcesses[tnnl.Id] = true
+				continue
 			}
+			cmd := t.backendFor(&tnnl).Command(&tnnl)
+
 			// Check if it this process is running
-			if !tnnl.PortInUse() {
-				// The process is dead.
-				// Check if we should be running this and restart.
-				if managedProcesses[tnnl.Id] {
-					// Should restart
-					log.WithFields(log.Fields{
-						"id":   tnnl.Id,
-						"name": tnnl.Name,
-						"cmd":  tnnl.getCommand(),
-					}).Info("Found dead process, restarting")
-					tnnl.Run(t.SshExec)
-					runningProcesses[tnnl.Id] = true
-				} else {
-					// Cleanup
-					log.WithFields(log.Fields{
-						"id":   tnnl.Id,
-						"name": tnnl.Name,
-						"cmd":  tnnl.getCommand(),
-					}).Info("Found dead process, cleaning up")
-					tnnl.Stop()
-				}
+			if tnnl.Status() == StatusDead {
+				// Cleanup
+				log.WithFields(log.Fields{
+					"id":   tnnl.Id,
+					"name": tnnl.Name,
+					"cmd":  cmd,
+				}).Info("Found dead process, cleaning up")
+				tnnl.Stop()
 			} else {
 				log.WithFields(log.Fields{
 					"id":   tnnl.Id,
 					"name": tnnl.Name,
-					"cmd":  tnnl.getCommand(),
+					"cmd":  cmd,
 				}).Debug("Found running process in pid dir")
 				runningProcesses[tnnl.Id] = true
 			}
 		}
 
+		// Keep the logs of managed tunnels, even while they are down
+		for tnnlId := range managedProcesses {
+			runningProcesses[tnnlId] = true
+		}
+
 		// Load all logfiles
 		// Clean up any not associated with a process that is live or being restarted
 		logFiles, err := filepath.Glob(fmt.Sprintf("%s/*.log", logDir))
@@ -19,6 +19,10 @@ func main() {
 	}
 
 	myTnnlr := &tnnlr.Tnnlr{}
+	var profiles string
+	var importProfile string
+	var importApply bool
+	var exportFormat, exportProfile, exportNames, exportOutput string
 	app := unpuzzled.NewApp()
 	app.Command = &unpuzzled.Command{
 		Name: "tnnlr",
@@ -32,15 +36,69 @@ func main() {
 			&unpuzzled.StringVariable{
 				Name:        "tunnels",
 				Destination: &(myTnnlr.TunnelReloadFile),
-				Description: "Configuration file listing tunnels. This can be read from and written to via the web UI.",
+				Description: "Configuration file listing tunnels, or an executable printing them as json. This can be read from and written to via the web UI.",
 				Default:     ".tnnlr",
 			},
+			&unpuzzled.StringVariable{
+				Name:        "format",
+				Destination: &(myTnnlr.Format),
+				Description: "Format of the tunnels file. Options are: [json,yaml,toml]. By default this is picked from the file extension (.yaml, .yml or .toml), falling back to json.",
+				Default:     "",
+			},
+			&unpuzzled.StringVariable{
+				Name:        "profiles",
+				Destination: &profiles,
+				Description: "More tunnels files to manage alongside the tunnels file, as a comma separated list of name=file, e.g. 'staging=staging.yaml,prod=prod.json'.",
+				Default:     "",
+			},
+			&unpuzzled.IntVariable{
+				Name:        "source-timeout",
+				Destination: &(myTnnlr.SourceTimeout),
+				Description: "Seconds to wait for tunnels files that are executables.",
+				Default:     30,
+			},
+			&unpuzzled.IntVariable{
+				Name:        "source-refresh",
+				Destination: &(myTnnlr.SourceRefresh),
+				Description: "Seconds between runs of tunnels files that are executables, to pick up changes. By default they only run when reloading.",
+				Default:     0,
+			},
+			&unpuzzled.StringVariable{
+				Name:        "ssh-config",
+				Destination: &(myTnnlr.SshConfig),
+				Description: "The ssh config to import tunnels from.",
+				Default:     "~/.ssh/config",
+			},
 			&unpuzzled.StringVariable{
 				Name:        "ssh-exec",
 				Destination: &(myTnnlr.SshExec),
 				Description: "The executable to use for ssh. Can be a full path or just a command name that works in your shell.",
 				Default:     "ssh",
 			},
+			&unpuzzled.StringVariable{
+				Name:        "backend",
+				Destination: &(myTnnlr.Backend),
+				Description: "How to run tunnels that don't set their own backend. Options are: [ssh,native]. 'ssh' runs the ssh executable, 'native' connects in-process without needing an ssh client.",
+				Default:     "ssh",
+			},
+			&unpuzzled.BoolVariable{
+				Name:        "detach",
+				Destination: &(myTnnlr.Detach),
+				Description: "Leave ssh and exec tunnels running when tnnlr exits. Tunnels left running are adopted the next time tnnlr starts.",
+				Default:     false,
+			},
+			&unpuzzled.BoolVariable{
+				Name:        "autostart",
+				Destination: &(myTnnlr.Autostart),
+				Description: "Start every tunnel in the tunnels file on startup. Without this only tunnels with \"autostart\": true are started.",
+				Default:     false,
+			},
+			&unpuzzled.BoolVariable{
+				Name:        "watch",
+				Destination: &(myTnnlr.Watch),
+				Description: "Reload the tunnels file whenever it changes. Only tunnels that were added, removed or changed are started or stopped.",
+				Default:     false,
+			},
 			&unpuzzled.IntVariable{
 				Name:        "port",
 				Destination: &(myTnnlr.Port),
@@ -49,27 +107,101 @@ func main() {
 			},
 		},
 		Action: func() {
+			parseProfiles(myTnnlr, profiles)
+
 			// Run web server
 			myTnnlr.Init()
 			myTnnlr.Run()
 		},
 		Subcommands: []*unpuzzled.Command{
-			/*
 			&unpuzzled.Command{
-				Name:      "ls",
-				Usage:     "List running tunnels",
-				Variables: []unpuzzled.Variable{},
+				Name:  "export",
+				Usage: "Export the tunnels in the tunnels file to run without tnnlr",
+				Variables: []unpuzzled.Variable{
+					&unpuzzled.StringVariable{
+						Name:        "as",
+						Destination: &exportFormat,
+						Description: fmt.Sprintf("The format to export as. Options are: [%s]", strings.Join(tnnlr.ExportFormats, ",")),
+						Default:     tnnlr.ExportBash,
+					},
+					&unpuzzled.StringVariable{
+						Name:        "profile",
+						Destination: &exportProfile,
+						Description: "The profile to export the tunnels of.",
+						Default:     tnnlr.DefaultProfile,
+					},
+					&unpuzzled.StringVariable{
+						Name:        "names",
+						Destination: &exportNames,
+						Description: "Comma separated names of the tunnels to export. By default every tunnel is exported.",
+						Default:     "",
+					},
+					&unpuzzled.StringVariable{
+						Name:        "output",
+						Destination: &exportOutput,
+						Description: "Directory to write the exported files to. By default a single file is written to stdout.",
+						Default:     "",
+					},
+				},
 				Action: func() {
-					myTnnlr.Init()
-					// NOT IMPLEMENTED
+					parseProfiles(myTnnlr, profiles)
+					var names []string
+					for _, name := range strings.Split(exportNames, ",") {
+						if name = strings.TrimSpace(name); name != "" {
+							names = append(names, name)
+						}
+					}
+					if err := myTnnlr.ExportToFiles(os.Stdout, exportProfile, exportFormat, names, exportOutput); err != nil {
+						logrus.WithFields(logrus.Fields{
+							"err": err,
+							"as":  exportFormat,
+						}).Fatal("Failed to export tunnels")
+					}
 				},
 			},
+			&unpuzzled.Command{
+				Name:  "import-ssh-config",
+				Usage: "Add the LocalForward, RemoteForward and DynamicForward entries of an ssh config to the tunnels file",
+				Variables: []unpuzzled.Variable{
+					&unpuzzled.StringVariable{
+						Name:        "profile",
+						Destination: &importProfile,
+						Description: "The profile to add the tunnels to.",
+						Default:     tnnlr.DefaultProfile,
+					},
+					&unpuzzled.BoolVariable{
+						Name:        "apply",
+						Destination: &importApply,
+						Description: "Write the tunnels to the tunnels file. Without this the tunnels that would be added are only listed.",
+						Default:     false,
+					},
+				},
+				Action: func() {
+					parseProfiles(myTnnlr, profiles)
+					if err := myTnnlr.ImportSshConfigToFile(os.Stdout, myTnnlr.SshConfig, importProfile, importApply); err != nil {
+						logrus.WithFields(logrus.Fields{
+							"err":       err,
+							"sshConfig": myTnnlr.SshConfig,
+						}).Fatal("Failed to import tunnels from ssh config")
+					}
+				},
+			},
+			/*
+				&unpuzzled.Command{
+					Name:      "ls",
+					Usage:     "List running tunnels",
+					Variables: []unpuzzled.Variable{},
+					Action: func() {
+						myTnnlr.Init()
+						// NOT IMPLEMENTED
+					},
+				},
 			*/
 		},
 	}
 	app.Authors = []unpuzzled.Author{
 		{
-			Name: "Timothy Van Heest",
+			Name:  "Timothy Van Heest",
 			Email: "timothy@ionic.com",
 		},
 	}
@@ -77,5 +209,20 @@ func main() {
 		unpuzzled.EnvironmentVariables,
 		unpuzzled.CliFlags,
 	}
+	// The settings summary is written to stdout, where it would end up in exported files
+	for _, arg := range os.Args[1:] {
+		if arg == "export" {
+			app.Silent = true
+		}
+	}
 	app.Run(os.Args)
 }
+
+func parseProfiles(t *tnnlr.Tnnlr, profiles string) {
+	var err error
+	if t.Profiles, err = tnnlr.ParseProfiles(profiles); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": err,
+		}).Fatal("Invalid value for option 'profiles'")
+	}
+}
@@ -6,70 +6,346 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"syscall"
-	"time"
+)
+
+// Tunnel types
+const (
+	TunnelTypeLocal   = "local"   // -L: make a port on the remote side available locally
+	TunnelTypeRemote  = "remote"  // -R: make a local port available on the remote host
+	TunnelTypeDynamic = "dynamic" // -D: run a SOCKS proxy on the local port
 )
 
 // Tunnels
 type Tunnel struct {
-	Id         string `json:"id"`
-	Name       string `form:"name" json:"name" binding:"required"`
-	DefaultUrl string `form:"defaultUrl" json:"defaultUrl" binding:"required"`
-	Host       string `form:"host" json:"host" binding:"required"`
-	Username   string `form:"username" json:"userName"` // can be ""
-	LocalPort  int32  `form:"localPort" json:"localPort" binding:"required"`
-	RemotePort int32  `form:"remotePort" json:"remotePort" binding:"required"`
-	Pid        int    `json:"pid"` // not set until after process starts
-	cmd        *exec.Cmd
+	Id         string `json:"id" yaml:"id,omitempty" toml:"id,omitempty"`
+	Name       string `form:"name" json:"name" yaml:"name" toml:"name" binding:"required"`
+	Type       string `form:"type" json:"type,omitempty" yaml:"type,omitempty" toml:"type,omitempty"` // "" is the same as "local"
+	DefaultUrl string `form:"defaultUrl" json:"defaultUrl" yaml:"defaultUrl" toml:"defaultUrl"`       // required unless dynamic or using a local socket
+	Host       string `form:"host" json:"host" yaml:"host" toml:"host" binding:"required"`
+	Username   string `form:"username" json:"userName" yaml:"userName,omitempty" toml:"userName,omitempty"` // can be ""
+	// Private key to authenticate with, defaults to ssh's default keys
+	IdentityFile string `form:"identityFile" json:"identityFile,omitempty" yaml:"identityFile,omitempty" toml:"identityFile,omitempty"`
+	// How the tunnel is run, "ssh", "native" or "exec", defaults to the server's backend
+	Backend string `form:"backend" json:"backend,omitempty" yaml:"backend,omitempty" toml:"backend,omitempty"`
+	// Command template run by the exec backend, e.g. "kubectl port-forward svc/grafana {{.LocalPort}}:{{.RemotePort}}"
+	Command string `form:"command" json:"command,omitempty" yaml:"command,omitempty" toml:"command,omitempty"`
+	// Bastions to hop through on the way to the host, in order, as [user@]host[:port]
+	JumpHosts []string `form:"jumpHosts" json:"jumpHosts,omitempty" yaml:"jumpHosts,omitempty" toml:"jumpHosts,omitempty"`
+	// The local address to listen on, defaults to ssh's default (usually loopback)
+	BindAddress string `form:"bindAddress" json:"bindAddress,omitempty" yaml:"bindAddress,omitempty" toml:"bindAddress,omitempty"`
+	LocalPort   int32  `form:"localPort" json:"localPort" yaml:"localPort" toml:"localPort"`     // required unless using a local socket
+	RemotePort  int32  `form:"remotePort" json:"remotePort" yaml:"remotePort" toml:"remotePort"` // required unless dynamic or using a remote socket
+	// Unix sockets can be used instead of either port, e.g. to forward a remote docker socket
+	LocalSocket  string `form:"localSocket" json:"localSocket,omitempty" yaml:"localSocket,omitempty" toml:"localSocket,omitempty"`
+	RemoteSocket string `form:"remoteSocket" json:"remoteSocket,omitempty" yaml:"remoteSocket,omitempty" toml:"remoteSocket,omitempty"`
+	// The host the ssh server connects to for local tunnels, e.g. a database behind a bastion
+	// Defaults to "localhost", i.e. the ssh server itself
+	RemoteHost string `form:"remoteHost" json:"remoteHost,omitempty" yaml:"remoteHost,omitempty" toml:"remoteHost,omitempty"`
+	// Hosts to route through a dynamic tunnel in the generated PAC file
+	// Either shell expressions (e.g. "*.internal") or IPv4 CIDRs (e.g. "10.0.0.0/16")
+	ProxyPatterns []string `form:"proxyPatterns" json:"proxyPatterns,omitempty" yaml:"proxyPatterns,omitempty" toml:"proxyPatterns,omitempty"`
+	// Additional forwards carried by the same ssh process
+	Forwards []Forward `json:"forwards,omitempty" yaml:"forwards,omitempty" toml:"forwards,omitempty"`
+	// Start the tunnel when tnnlr starts
+	Autostart bool `form:"autostart" json:"autostart,omitempty" yaml:"autostart,omitempty" toml:"autostart,omitempty"`
+	// What to do when the tunnel dies: "always" (the default), "on-failure" or "never"
+	Restart string `form:"restart" json:"restart,omitempty" yaml:"restart,omitempty" toml:"restart,omitempty"`
+	// Restarts in a row before the tunnel is marked as crash-looping and left down
+	// Defaults to 5, -1 retries forever
+	MaxRetries int `form:"maxRetries" json:"maxRetries,omitempty" yaml:"maxRetries,omitempty" toml:"maxRetries,omitempty"`
+	// Seconds to wait before restarting, doubled for each restart in a row, defaults to 1
+	RestartBackoff int `form:"restartBackoff" json:"restartBackoff,omitempty" yaml:"restartBackoff,omitempty" toml:"restartBackoff,omitempty"`
+	// Upper limit for RestartBackoff, defaults to 300
+	RestartBackoffMax int `form:"restartBackoffMax" json:"restartBackoffMax,omitempty" yaml:"restartBackoffMax,omitempty" toml:"restartBackoffMax,omitempty"`
+
+	Pid      int `json:"pid" yaml:"-" toml:"-"` // not set until after process starts, and left out of yaml and toml files
+	backend  TunnelBackend
+	restarts *restartState
+	proc     *process      // set by backends that run a process
+	native   *nativeTunnel // set by the native backend
+	profile  string        // the profile the tunnel was loaded into, "" for the default
+	owner    int           // pid of the tnnlr that wrote the pid file the tunnel was read from
+}
+
+// The type of the tunnel, with the default filled in
+func (t *Tunnel) Kind() string {
+	if t.Type == "" {
+		return TunnelTypeLocal
+	}
+	return t.Type
+}
+
+func (t *Tunnel) IsRemote() bool {
+	return t.Type == TunnelTypeRemote
+}
+
+// The name of the profile the tunnel belongs to
+func (t *Tunnel) Profile() string {
+	if t.profile == "" {
+		return DefaultProfile
+	}
+	return t.profile
 }
 
+func (t *Tunnel) IsDynamic() bool {
+	return t.Type == TunnelTypeDynamic
+}
+
+// The full set of forwards for this tunnel, starting with the one described by the tunnel's own fields
+func (t *Tunnel) AllForwards() []Forward {
+	forwards := []Forward{{
+		BindAddress:  t.BindAddress,
+		LocalPort:    t.LocalPort,
+		LocalSocket:  t.LocalSocket,
+		RemoteHost:   t.RemoteHost,
+		RemotePort:   t.RemotePort,
+		RemoteSocket: t.RemoteSocket,
+		DefaultUrl:   t.DefaultUrl,
+	}}
+	for _, f := range t.Forwards {
+		if f.BindAddress == "" {
+			f.BindAddress = t.BindAddress
+		}
+		forwards = append(forwards, f)
+	}
+	return forwards
+}
+
+// Wrap IPv6 addresses in brackets so they can be used in forwarding specs
+func sshAddress(host string) string {
+	if strings.Contains(host, ":") {
+		return fmt.Sprintf("[%s]", host)
+	}
+	return host
+}
+
+// The command for the tunnel, as run by its backend
+// Tunnels that haven't been run (e.g. loaded from pid files) show the command they would run
 func (t *Tunnel) getCommand() string {
+	if t.backend != nil {
+		return t.backend.Command(t)
+	}
+	if t.Backend == BackendExec {
+		return (&execBackend{}).Command(t)
+	}
+	return t.sshCommand()
+}
+
+// The ssh command for the tunnel, for display
+func (t *Tunnel) sshCommand() string {
+	quoted := []string{"ssh", "-v"}
+	for _, arg := range t.sshArgs() {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// The arguments to ssh for the tunnel, other than verbosity
+func (t *Tunnel) sshArgs() []string {
+	var opts []string
+
+	// Hosts for the native backend can include the port, which ssh takes as a flag
 	remote := t.Host
+	if host, port, err := net.SplitHostPort(t.Host); err == nil {
+		remote = host
+		opts = append(opts, "-p", port)
+	}
 	if t.Username != "" {
 		remote = fmt.Sprintf("%s@%s", t.Username, remote)
 	}
-	return fmt.Sprintf(`ssh -v -L %d:localhost:%d %s -N`,
-		t.LocalPort,
-		t.RemotePort,
-		remote,
-	)
+
+	if t.IdentityFile != "" {
+		opts = append(opts, "-i", t.IdentityFile)
+	}
+	if len(t.JumpHosts) > 0 {
+		opts = append(opts, "-J", strings.Join(t.JumpHosts, ","))
+	}
+	unlinkSockets := false
+	for _, f := range t.AllForwards() {
+		opts = append(opts, f.args(t.Kind())...)
+		unlinkSockets = unlinkSockets || f.usesSockets()
+	}
+	// Replace socket files left behind by an earlier run instead of failing to bind
+	if unlinkSockets {
+		opts = append(opts, "-o", "StreamLocalBindUnlink=yes")
+	}
+	// Exit instead of running without the forwards, so the tunnel shows as dead and is restarted
+	opts = append(opts, "-o", "ExitOnForwardFailure=yes")
+
+	return append(opts, remote, "-N")
+}
+
+// One of StatusStarting, StatusUp, StatusDead, StatusCrashLooping or StatusStopped
+// Tunnels loaded from pid files are checked through their pid.
+func (t *Tunnel) Status() string {
+	if t.isStopped() {
+		return StatusStopped
+	}
+	if t.isCrashLooping() {
+		return StatusCrashLooping
+	}
+	if t.backend != nil {
+		return t.backend.Status(t)
+	}
+	// Native tunnels run by this process have a backend, so this is left over from an earlier one
+	if t.Pid == os.Getpid() || !t.ProcessRunning() {
+		return StatusDead
+	}
+	return t.runningStatus()
 }
 
-// Check if process running the tunnel is alive
-// FIXME: Seems to return true even if process has exited
+// Check if the tunnel is up and forwarding
 func (t *Tunnel) IsAlive() bool {
-	if !t.PortInUse() {
-		return false
+	return t.Status() == StatusUp
+}
+
+// Details on the state of the connection or why it went down, where the backend knows them
+func (t *Tunnel) ConnectionState() string {
+	if t.native != nil {
+		return t.native.Status()
+	}
+	if t.proc != nil {
+		return t.proc.ExitReason()
 	}
+	return ""
+}
+
+// Check if the process with the tunnel's pid is running the tunnel
+// Works for tunnels loaded from pid files, which have no process of their own
+func (t *Tunnel) ProcessRunning() bool {
+	return pidRunning(t.Pid, t.ownsCmdline)
+}
 
-	if t.cmd == nil {
+// Check if a pid is running, and that its command line passes owns
+func pidRunning(pid int, owns func(cmdline []string) bool) bool {
+	if pid == 0 {
 		return false
 	}
-	if t.cmd.Process == nil {
+	p, err := os.FindProcess(pid)
+	if err != nil {
 		return false
 	}
-
-	// https://stackoverflow.com/questions/15204162/check-if-a-process-exists-in-go-way
-	if err := t.cmd.Process.Signal(syscall.Signal(0)); err != nil {
+	// FindProcess fails for missing processes on windows, and sending signals is not supported there
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	if p.Signal(syscall.Signal(0)) != nil {
 		return false
 	}
 
-	// ProcessState is set after a call to `Wait` or `Run`
-	if t.cmd.ProcessState != nil {
-		return t.cmd.ProcessState.Exited()
+	// The pid may have been reused by an unrelated process since the pid file was written
+	cmdline, err := processCmdline(pid)
+	if err == errCmdlineUnsupported {
+		return true
 	}
-
-	return true
+	return err == nil && owns(cmdline)
 }
 
-// FIXME: Check required fields
+// Check the tunnel's fields, returning every problem found as `ValidationErrors`
 func (t *Tunnel) Validate() error {
+	if errs := t.validationErrors(); len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
+// Problems with the tunnel's fields, with an index of -1
+func (t *Tunnel) validationErrors() ValidationErrors {
+	var errs ValidationErrors
+	add := func(field, format string, a ...interface{}) {
+		errs = append(errs, ValidationError{Index: -1, Field: field, Message: fmt.Sprintf(format, a...)})
+	}
+
+	if strings.TrimSpace(t.Name) == "" {
+		add("name", "Name is required")
+	}
+	switch {
+	case strings.TrimSpace(t.Host) == "":
+		add("host", "Host is required")
+	case strings.ContainsAny(t.Host, " \t"):
+		add("host", "Invalid host '%s'", t.Host)
+	}
+
+	switch t.Type {
+	case "", TunnelTypeLocal, TunnelTypeRemote:
+		if t.DefaultUrl == "" && t.LocalSocket == "" {
+			add("defaultUrl", "Default URL is required for %s tunnels", t.Kind())
+		}
+	case TunnelTypeDynamic:
+		for _, pattern := range t.ProxyPatterns {
+			if err := validateProxyPattern(pattern); err != nil {
+				add("proxyPatterns", "Invalid proxy pattern '%s': %s", pattern, err.Error())
+			}
+		}
+	default:
+		add("type", "Unknown tunnel type '%s'", t.Type)
+	}
+
+	switch t.Backend {
+	case "", BackendSsh, BackendNative:
+		if t.Command != "" {
+			add("command", "Command is only used by the exec backend")
+		}
+	case BackendExec:
+		if t.Command == "" {
+			add("command", "Command is required for the exec backend")
+		} else if _, err := t.renderCommand(); err != nil {
+			add("command", "Invalid command template: %s", err.Error())
+		}
+	default:
+		add("backend", "Unknown backend '%s'", t.Backend)
+	}
+	errs = append(errs, validateRestartPolicy(t)...)
+
+	for _, jumpHost := range t.JumpHosts {
+		if strings.ContainsAny(jumpHost, ", ") {
+			add("jumpHosts", "Invalid jump host '%s'", jumpHost)
+		}
+	}
+
+	// The listening end of each forward must be unique
+	listening := make(map[string]bool)
+	for i, f := range t.AllForwards() {
+		prefix := forwardPrefix(i)
+		fErrs := f.validationErrors(t.Kind(), prefix)
+		errs = append(errs, fErrs...)
+		if len(fErrs) > 0 {
+			continue
+		}
+		end, field := f.LocalEnd(), f.localEndField()
+		if t.IsRemote() {
+			end, field = f.RemoteEnd(), f.remoteEndField()
+		}
+		if listening[end] {
+			add(prefix+field, "%s is used more than once", end)
+		}
+		listening[end] = true
+	}
+	return errs
+}
+
+// Split comma separated values submitted through the html form into separate list items
+func (t *Tunnel) splitFormLists() {
+	t.ProxyPatterns = splitList(t.ProxyPatterns)
+	t.JumpHosts = splitList(t.JumpHosts)
+}
+
+func splitList(items []string) []string {
+	var out []string
+	for _, item := range items {
+		for _, part := range strings.Split(item, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
 func (t *Tunnel) LogPath() (string, error) {
 	return getRelativePath(filepath.Join(relLog, fmt.Sprintf("%s.log", t.Id)))
 }
@@ -78,15 +354,14 @@ func (t *Tunnel) PidPath() (string, error) {
 	return getRelativePath(filepath.Join(relProc, fmt.Sprintf("%s.pid", t.Id)))
 }
 
-func (t *Tunnel) PortInUse() bool {
-	// Check if this port is already in use
-	// https://stackoverflow.com/questions/40296483/continuously-check-if-tcp-port-is-in-use
-	conn, _ := net.DialTimeout("tcp", net.JoinHostPort("", fmt.Sprintf("%d", t.LocalPort)), time.Duration(1*time.Millisecond))
-	if conn != nil {
-		conn.Close()
-		return true
+// Check if all of the tunnel's local ports and sockets are in use
+func (t *Tunnel) ForwardsInUse() bool {
+	for _, f := range t.AllForwards() {
+		if !f.InUse() {
+			return false
+		}
 	}
-	return false
+	return true
 }
 
 // Run the cmd and set the active process
@@ -94,7 +369,7 @@ func (t *Tunnel) PortInUse() bool {
 Writes process information into ~/.tnnl/proc/XXX.pid
 Writes log information into ~/.tnnl/log/XXX.log
 */
-func (t *Tunnel) Run(sshExec string) error {
+func (t *Tunnel) Run(backend TunnelBackend) error {
 	var err error
 
 	// Stop if already running
@@ -102,37 +377,33 @@ func (t *Tunnel) Run(sshExec string) error {
 		return err
 	}
 
-	if t.PortInUse() {
-		return fmt.Errorf("Port %d is already in use", t.LocalPort)
+	// For remote tunnels the local port is expected to be in use by the service being exposed
+	if !t.IsRemote() {
+		for _, f := range t.AllForwards() {
+			if f.InUse() {
+				return fmt.Errorf("%s is already in use", f.LocalEnd())
+			}
+		}
 	}
 
-	// Set up logging and launch task
-	// FIXME: Allow this to live beyond the life of the process
-	logPath, err := t.LogPath()
-	if err != nil {
-		return err
-	}
-	logOut, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	cmdParts := strings.Split(t.getCommand(), " ")
-	cmd := exec.Command(sshExec, cmdParts[1:]...)
-	cmd.Stdout = logOut
-	cmd.Stderr = logOut
-	err = cmd.Start()
-	if err != nil {
-		return err
+	t.backend = backend
+	if t.restarts == nil {
+		t.restarts = newRestartState()
 	}
-	t.cmd = cmd
-	t.Pid = cmd.Process.Pid
+	return backend.Start(t)
+}
 
-	// Write JSON representation of task to pid file
+// Write JSON representation of task to pid file
+func (t *Tunnel) writePidFile() error {
 	pidPath, err := t.PidPath()
 	if err != nil {
 		return err
 	}
-	tJSON, err := json.Marshal(t)
+	tJSON, err := json.Marshal(pidFile{
+		Tunnel:  *t,
+		Owner:   os.Getpid(),
+		Profile: t.profile,
+	})
 	if err != nil {
 		return err
 	}
@@ -144,11 +415,41 @@ func (t *Tunnel) Run(sshExec string) error {
 	return nil
 }
 
+// The contents of a pid file: the tunnel, and who is managing it
+type pidFile struct {
+	Tunnel
+	Owner   int    `json:"owner,omitempty"` // pid of the tnnlr managing the tunnel
+	Profile string `json:"profile,omitempty"`
+}
+
+// Read a tunnel from its pid file
+func readPidFile(path string) (Tunnel, int, error) {
+	var pf pidFile
+	c, err := ioutil.ReadFile(path)
+	if err != nil {
+		return pf.Tunnel, 0, err
+	}
+	err = json.Unmarshal(c, &pf)
+	pf.Tunnel.profile, pf.Tunnel.owner = pf.Profile, pf.Owner
+	return pf.Tunnel, pf.Owner, err
+}
+
+// Whether a pid file belongs to another tnnlr that is still running
+// Tunnels of other tnnlrs are left alone, so running more than one tnnlr at once is safe.
+func ownedByOtherTnnlr(owner int) bool {
+	if owner == 0 || owner == os.Getpid() {
+		return false
+	}
+	return pidRunning(owner, func(cmdline []string) bool {
+		return len(cmdline) > 0 && filepath.Base(cmdline[0]) == filepath.Base(os.Args[0])
+	})
+}
+
 // Stop the tunnel if already running
 func (t *Tunnel) Stop() error {
-	if t.cmd != nil {
-		if t.cmd.Process != nil {
-			return t.cmd.Process.Kill()
+	if t.backend != nil {
+		if err := t.backend.Stop(t); err != nil {
+			return err
 		}
 	}
 	// Clear pid file path
@@ -0,0 +1,303 @@
+package tnnlr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	toml "github.com/pelletier/go-toml"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+/*
+Checking the tunnels file before anything is started from it.
+
+Every problem is reported at once, each tied to the position of the tunnel in the file and the name
+of the field as it is written in the file, e.g. `tunnels[2].forwards[0].localPort`.
+*/
+
+// A problem with a single field of a tunnel
+type ValidationError struct {
+	Index   int    `json:"index"`   // position of the tunnel in the file, or -1 if it isn't from the file
+	Field   string `json:"field"`   // name of the field in the file, or "" for problems with the file as a whole
+	Message string `json:"message"` // what is wrong
+}
+
+func (e ValidationError) Error() string {
+	path := e.Field
+	if e.Index >= 0 {
+		path = fmt.Sprintf("tunnels[%d]", e.Index)
+		if e.Field != "" {
+			path += "." + e.Field
+		}
+	}
+	if path == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", path, e.Message)
+}
+
+// All the problems found while validating
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Set the position in the file of the tunnel the errors are about
+func (errs ValidationErrors) withIndex(index int) ValidationErrors {
+	for i := range errs {
+		errs[i].Index = index
+	}
+	return errs
+}
+
+// Move the errors about tunnels from a source to after the tunnels of the file
+func (errs ValidationErrors) withIndexOffset(offset int) ValidationErrors {
+	for i := range errs {
+		if errs[i].Index >= 0 {
+			errs[i].Index += offset
+		}
+	}
+	return errs
+}
+
+// Point errors about tunnels past the first fromFile at the source's output instead of the file
+func (errs ValidationErrors) fromSource(fromFile int) ValidationErrors {
+	for i := range errs {
+		if errs[i].Index < fromFile {
+			continue
+		}
+		field := fmt.Sprintf("source.tunnels[%d]", errs[i].Index-fromFile)
+		if errs[i].Field != "" {
+			field += "." + errs[i].Field
+		}
+		errs[i].Index, errs[i].Field = -1, field
+	}
+	return errs
+}
+
+// A forward listening locally, and the tunnel it belongs to
+type localEnd struct {
+	index   int
+	forward Forward
+}
+
+// Check a list of tunnels, both each tunnel on its own and that they don't clash with each other
+func ValidateTunnels(tunnels []Tunnel) ValidationErrors {
+	return validateTunnels(tunnels, func(j int) string {
+		return fmt.Sprintf("tunnels[%d]", j)
+	})
+}
+
+// Check a list of tunnels, with clashes naming the other tunnel by `describe`
+func validateTunnels(tunnels []Tunnel, describe func(j int) string) ValidationErrors {
+	var errs ValidationErrors
+	ids := make(map[string]int)
+	names := make(map[string]int)
+	// Compared pairwise, since a forward listening on all interfaces clashes with every address
+	var localEnds []localEnd
+	for i := range tunnels {
+		tnnl := &tunnels[i]
+		errs = append(errs, tnnl.validationErrors().withIndex(i)...)
+
+		if j, ok := ids[tnnl.Id]; ok && tnnl.Id != "" {
+			errs = append(errs, ValidationError{i, "id", fmt.Sprintf("Id '%s' is already used by %s", tnnl.Id, describe(j))})
+		} else {
+			ids[tnnl.Id] = i
+		}
+		if j, ok := names[tnnl.Name]; ok && tnnl.Name != "" {
+			errs = append(errs, ValidationError{i, "name", fmt.Sprintf("Name '%s' is already used by %s", tnnl.Name, describe(j))})
+		} else {
+			names[tnnl.Name] = i
+		}
+
+		// Remote tunnels listen on the remote host, so only local ends of other tunnels can clash
+		if tnnl.IsRemote() {
+			continue
+		}
+		for n, f := range tnnl.AllForwards() {
+			if f.LocalPort == 0 && f.LocalSocket == "" {
+				continue
+			}
+			for _, other := range localEnds {
+				if other.index != i && f.localClash(other.forward) {
+					errs = append(errs, ValidationError{i, forwardPrefix(n) + f.localEndField(), fmt.Sprintf("%s is already used by %s", other.forward.listenEnd(), describe(other.index))})
+					break
+				}
+			}
+			localEnds = append(localEnds, localEnd{i, f})
+		}
+	}
+	return errs
+}
+
+// The field names a struct is written with in tunnels files, from its json tags
+func fileFieldNames(v interface{}) map[string]bool {
+	names := make(map[string]bool)
+	typ := reflect.TypeOf(v)
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+var (
+	tunnelFieldNames  = fileFieldNames(Tunnel{})
+	forwardFieldNames = fileFieldNames(Forward{})
+)
+
+// Check a tunnel or forward for keys that aren't fields, which would otherwise be silently ignored
+func unknownKeys(index int, prefix string, item map[string]interface{}, known map[string]bool) ValidationErrors {
+	var keys []string
+	for key := range item {
+		if !known[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var errs ValidationErrors
+	for _, key := range keys {
+		message := fmt.Sprintf("Unknown field '%s'", key)
+		for name := range known {
+			if strings.EqualFold(name, key) {
+				message += fmt.Sprintf(", did you mean '%s'?", name)
+			}
+		}
+		errs = append(errs, ValidationError{index, prefix + key, message})
+	}
+	return errs
+}
+
+// Convert yaml's maps to maps with string keys, so all formats can be checked the same way
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for key, value := range v {
+			m[fmt.Sprint(key)] = stringKeys(value)
+		}
+		return m
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = stringKeys(value)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = stringKeys(value)
+		}
+		return v
+	}
+	return v
+}
+
+// Find keys in a tunnels file that don't match any field
+// The file is assumed to have decoded successfully already, so anything unexpected in its shape is skipped.
+func unknownFields(raw []byte, format string) ValidationErrors {
+	var doc interface{}
+	var errs ValidationErrors
+	switch format {
+	case FormatYAML:
+		if yaml.Unmarshal(raw, &doc) != nil {
+			return nil
+		}
+	case FormatTOML:
+		tree, err := toml.LoadBytes(raw)
+		if err != nil {
+			return nil
+		}
+		doc = tree.ToMap()
+	default:
+		if json.Unmarshal(raw, &doc) != nil {
+			return nil
+		}
+	}
+
+	// Files with variables have the list of tunnels under a key, see `tunnelsFile`
+	doc = stringKeys(doc)
+	if top, ok := doc.(map[string]interface{}); ok {
+		errs = append(errs, unknownKeys(-1, "", top, fileFieldNames(tunnelsFile{}))...)
+		doc = top["tunnels"]
+	}
+	items, _ := doc.([]interface{})
+	for i, item := range items {
+		tnnl, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		errs = append(errs, unknownTunnelKeys(i, tnnl, tunnelFieldNames)...)
+	}
+	return errs
+}
+
+// Check a tunnel and its forwards for keys that aren't fields
+func unknownTunnelKeys(index int, tnnl map[string]interface{}, known map[string]bool) ValidationErrors {
+	errs := unknownKeys(index, "", tnnl, known)
+	forwards, _ := tnnl["forwards"].([]interface{})
+	for n, forward := range forwards {
+		if f, ok := forward.(map[string]interface{}); ok {
+			errs = append(errs, unknownKeys(index, forwardPrefix(n+1), f, forwardFieldNames)...)
+		}
+	}
+	return errs
+}
+
+// Report a failure to load a tunnels file, with a message for each problem found in it
+func (t *Tnnlr) reportLoadError(p *Profile, message string, err error) {
+	log.WithFields(log.Fields{
+		"err":  err.Error(),
+		"file": p.File,
+	}).Error(message)
+	if p.Name != DefaultProfile {
+		message = fmt.Sprintf("%s (profile '%s')", message, p.Name)
+	}
+	t.AddMessage(message)
+	if errs, ok := err.(ValidationErrors); ok {
+		for _, e := range errs {
+			t.AddMessage(e.Error())
+		}
+	}
+}
+
+// Check a tunnels file without loading anything from it
+// Responds with every problem found, and a 422 status if there are any.
+func (t *Tnnlr) ValidateFile(c *gin.Context) {
+	p, err := t.requestProfile(c)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = p.Load()
+	switch errs := err.(type) {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"file": p.File, "valid": true, "errors": ValidationErrors{}})
+	case ValidationErrors:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"file": p.File, "valid": false, "errors": errs})
+	default:
+		status := http.StatusUnprocessableEntity
+		if os.IsNotExist(err) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{
+			"file":   p.File,
+			"valid":  false,
+			"errors": ValidationErrors{{Index: -1, Message: err.Error()}},
+		})
+	}
+}
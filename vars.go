@@ -0,0 +1,147 @@
+package tnnlr
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+/*
+Variables in the tunnels file.
+
+Hosts, usernames, jump hosts and default URLs can refer to variables as `${VAR}`, or as
+`${VAR:-default}` to fall back to a default when the variable is unset or empty. Variables are
+looked up in the environment first and then in the `variables` block of the tunnels file, so a
+shared file can hold defaults that each person overrides in their environment.
+
+Tunnels run with the expanded values. When saving, fields whose value is still what the
+placeholder in the file expands to are written back as the placeholder.
+*/
+
+var placeholderPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// Look up variables in the environment, then in the tunnels file
+func variableLookup(variables map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		if value, ok := os.LookupEnv(name); ok {
+			return value, true
+		}
+		value, ok := variables[name]
+		return value, ok
+	}
+}
+
+// Replace the placeholders in a value
+// Placeholders for unset variables without a default are left in place, and reported in the error.
+func expandVariables(value string, lookup func(string) (string, bool)) (string, error) {
+	var missing []string
+	expanded := placeholderPattern.ReplaceAllStringFunc(value, func(placeholder string) string {
+		m := placeholderPattern.FindStringSubmatch(placeholder)
+		v, ok := lookup(m[1])
+		switch {
+		case ok && v != "":
+			return v
+		case m[2] != "":
+			return m[3]
+		case ok:
+			return v
+		}
+		missing = append(missing, m[1])
+		return placeholder
+	})
+	if len(missing) > 0 {
+		return expanded, fmt.Errorf("Variable '%s' is not set", strings.Join(missing, "', '"))
+	}
+	return expanded, nil
+}
+
+// A field of a tunnel that can use variables
+type templatedField struct {
+	name  string // as written in the tunnels file
+	value *string
+}
+
+func (t *Tunnel) templatedFields() []templatedField {
+	fields := []templatedField{
+		{"host", &t.Host},
+		{"userName", &t.Username},
+		{"defaultUrl", &t.DefaultUrl},
+	}
+	for i := range t.JumpHosts {
+		fields = append(fields, templatedField{fmt.Sprintf("jumpHosts[%d]", i), &t.JumpHosts[i]})
+	}
+	for i := range t.Forwards {
+		fields = append(fields, templatedField{forwardPrefix(i+1) + "defaultUrl", &t.Forwards[i].DefaultUrl})
+	}
+	return fields
+}
+
+// Expand the variables used by tunnels in place, with an error for each field that can't be expanded
+func expandTunnels(tunnels []Tunnel, variables map[string]string) ValidationErrors {
+	lookup := variableLookup(variables)
+	var errs ValidationErrors
+	for i := range tunnels {
+		for _, field := range tunnels[i].templatedFields() {
+			expanded, err := expandVariables(*field.value, lookup)
+			if err != nil {
+				errs = append(errs, ValidationError{i, field.name, err.Error()})
+			}
+			*field.value = expanded
+		}
+	}
+	return errs
+}
+
+// Copies of tunnels about to be saved, with the placeholders from the tunnels file put back
+// Tunnels are matched to the file by id, or by name. A field only gets its placeholder back if the
+// placeholder still expands to the field's value, so edits aren't lost.
+func restorePlaceholders(tunnels []*Tunnel, file tunnelsFile) []*Tunnel {
+	byId := make(map[string]*Tunnel)
+	byName := make(map[string]*Tunnel)
+	for i := range file.Tunnels {
+		original := &file.Tunnels[i]
+		if original.Id != "" {
+			byId[original.Id] = original
+		}
+		byName[original.Name] = original
+	}
+	lookup := variableLookup(file.Variables)
+
+	restored := make([]*Tunnel, len(tunnels))
+	for i, tnnl := range tunnels {
+		restored[i] = tnnl
+		original, ok := byId[tnnl.Id]
+		if !ok {
+			original, ok = byName[tnnl.Name]
+		}
+		if !ok {
+			continue
+		}
+		placeholders := make(map[string]string)
+		for _, field := range original.templatedFields() {
+			if placeholderPattern.MatchString(*field.value) {
+				placeholders[field.name] = *field.value
+			}
+		}
+		if len(placeholders) == 0 {
+			continue
+		}
+
+		// Don't touch the lists of the running tunnel
+		saved := *tnnl
+		saved.JumpHosts = append([]string(nil), tnnl.JumpHosts...)
+		saved.Forwards = append([]Forward(nil), tnnl.Forwards...)
+		for _, field := range saved.templatedFields() {
+			placeholder, ok := placeholders[field.name]
+			if !ok {
+				continue
+			}
+			if expanded, err := expandVariables(placeholder, lookup); err == nil && expanded == *field.value {
+				*field.value = placeholder
+			}
+		}
+		restored[i] = &saved
+	}
+	return restored
+}
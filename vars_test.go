@@ -0,0 +1,92 @@
+package tnnlr
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestExpandVariables(t *testing.T) {
+	variables := map[string]string{"USER_NAME": "me", "EMPTY": "", "BASTION": "bastion.example.com"}
+	lookup := func(name string) (string, bool) {
+		value, ok := variables[name]
+		return value, ok
+	}
+	cases := []struct {
+		value    string
+		expanded string
+		err      bool
+	}{
+		{"example.com", "example.com", false},
+		{"${USER_NAME}", "me", false},
+		{"${USER_NAME}@${BASTION}:2222", "me@bastion.example.com:2222", false},
+		{"${USER_NAME:-you}", "me", false},
+		{"${UNSET:-you}", "you", false},
+		{"${EMPTY:-you}", "you", false},
+		{"${EMPTY}", "", false},
+		{"${UNSET:-}", "", false},
+		{"${UNSET:-http://localhost:8080/}", "http://localhost:8080/", false},
+		{"${UNSET}.example.com", "${UNSET}.example.com", true},
+		{"$USER_NAME ${1NVALID}", "$USER_NAME ${1NVALID}", false},
+	}
+	for _, c := range cases {
+		expanded, err := expandVariables(c.value, lookup)
+		if expanded != c.expanded || (err != nil) != c.err {
+			t.Errorf("Expanding %q gives %q and error %v, expected %q and error %v", c.value, expanded, err, c.expanded, c.err)
+		}
+	}
+}
+
+func TestRestorePlaceholders(t *testing.T) {
+	os.Setenv("TNNLR_TEST_HOST", "env.example.com")
+	defer os.Unsetenv("TNNLR_TEST_HOST")
+
+	file := tunnelsFile{
+		Variables: map[string]string{"TNNLR_TEST_HOST": "file.example.com", "TNNLR_TEST_USER": "me"},
+		Tunnels: []Tunnel{
+			{Id: "1", Name: "web", Host: "${TNNLR_TEST_HOST}", Username: "${TNNLR_TEST_USER:-you}"},
+			{Name: "db", Host: "${TNNLR_TEST_DB:-db.example.com}", JumpHosts: []string{"${TNNLR_TEST_USER}@bastion"}},
+		},
+	}
+	cases := []struct {
+		running  Tunnel
+		restored Tunnel
+	}{
+		// Unchanged values get their placeholders back, with the environment winning over the file
+		{
+			Tunnel{Id: "1", Name: "web", Host: "env.example.com", Username: "me"},
+			Tunnel{Id: "1", Name: "web", Host: "${TNNLR_TEST_HOST}", Username: "${TNNLR_TEST_USER:-you}"},
+		},
+		// Defaults round trip, and tunnels without an id are matched by name
+		{
+			Tunnel{Id: "2", Name: "db", Host: "db.example.com", JumpHosts: []string{"me@bastion"}},
+			Tunnel{Id: "2", Name: "db", Host: "${TNNLR_TEST_DB:-db.example.com}", JumpHosts: []string{"${TNNLR_TEST_USER}@bastion"}},
+		},
+		// Edited values are kept
+		{
+			Tunnel{Id: "1", Name: "web", Host: "file.example.com", Username: "you"},
+			Tunnel{Id: "1", Name: "web", Host: "file.example.com", Username: "you"},
+		},
+		// Renamed tunnels are still matched by id
+		{
+			Tunnel{Id: "1", Name: "www", Host: "env.example.com"},
+			Tunnel{Id: "1", Name: "www", Host: "${TNNLR_TEST_HOST}"},
+		},
+		{
+			Tunnel{Id: "3", Name: "new", Host: "env.example.com"},
+			Tunnel{Id: "3", Name: "new", Host: "env.example.com"},
+		},
+	}
+	for _, c := range cases {
+		running := c.running
+		running.JumpHosts = append([]string(nil), c.running.JumpHosts...)
+		restored := restorePlaceholders([]*Tunnel{&running}, file)[0]
+		if !reflect.DeepEqual(*restored, c.restored) {
+			t.Errorf("Restoring %+v gives %+v, expected %+v", c.running, *restored, c.restored)
+		}
+		// The running tunnel keeps its expanded values
+		if !reflect.DeepEqual(running, c.running) {
+			t.Errorf("Restoring changed the running tunnel to %+v", running)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package tnnlr
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often the tunnels file is checked for changes
+const watchInterval = 2 * time.Second
+
+/*
+Reload a profile's tunnels file whenever it changes.
+
+This polls the file instead of using filesystem notifications, so it works the same everywhere and
+keeps working when tools replace the file instead of editing it.  Edits that don't parse are reported
+and otherwise ignored, so a half-written file never takes down running tunnels.
+*/
+func (t *Tnnlr) WatchTunnelsFile(p *Profile) {
+	var lastMod time.Time
+	var lastSize int64
+	var lastSum [sha256.Size]byte
+	if info, err := os.Stat(p.File); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+	if raw, err := ioutil.ReadFile(p.File); err == nil {
+		lastSum = sha256.Sum256(raw)
+	}
+
+	for {
+		time.Sleep(watchInterval)
+
+		info, err := os.Stat(p.File)
+		if err != nil || (info.ModTime().Equal(lastMod) && info.Size() == lastSize) {
+			continue
+		}
+		lastMod, lastSize = info.ModTime(), info.Size()
+
+		// Ignore the file being touched without being changed
+		raw, err := ioutil.ReadFile(p.File)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(raw)
+		if sum == lastSum {
+			continue
+		}
+		lastSum = sum
+
+		log.WithFields(log.Fields{
+			"file": p.File,
+		}).Info("Tunnels file changed")
+		tmpTunnels, err := p.Load()
+		if err != nil {
+			t.reportLoadError(p, "Tunnels file changed but failed to parse, leaving tunnels as they are", err)
+			continue
+		}
+
+		// Saving from the web UI rewrites the file without changing the tunnels in it
+		t.reloadLock.Lock()
+		if plan := t.PlanReconcile(p, tmpTunnels); planHasChanges(plan) {
+			t.ApplyReconcile(p, plan)
+		}
+		t.reloadLock.Unlock()
+	}
+}